@@ -0,0 +1,92 @@
+package rln
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInternal is returned when an unexpected failure, such as a panic, happens
+// while calling into zerokit
+var ErrInternal = errors.New("internal rln error")
+
+// ErrMemberNotFound is returned when a membership could not be found in the merkle tree
+var ErrMemberNotFound = errors.New("member not found")
+
+// ErrUnsupportedDepth is returned when a tree depth is not supported
+var ErrUnsupportedDepth = errors.New("unsupported tree depth")
+
+// ErrDegenerateProof is returned when a proof has an empty zkSNARK proof, merkle
+// root or nullifier, which can be rejected without running the verification
+var ErrDegenerateProof = errors.New("invalid proof: degenerate proof")
+
+// ErrInvalidRoot is returned when one of the roots a proof is verified against is malformed
+var ErrInvalidRoot = errors.New("invalid root")
+
+// ErrExternalNullifierMismatch is returned when a proof was generated for an external
+// nullifier different from the expected one
+var ErrExternalNullifierMismatch = errors.New("invalid proof: external nullifier mismatch")
+
+// ErrTreeFull is returned when the members don't fit in a Merkle tree
+var ErrTreeFull = errors.New("merkle tree is full")
+
+// ErrEpochOutOfWindow is returned when an epoch is not within the acceptable window
+var ErrEpochOutOfWindow = errors.New("epoch out of window")
+
+// ErrInvalidSnapshot is returned when restoring data that is not a valid snapshot
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// ErrIncompatibleArtifacts is returned by NewRLNWithParamsChecked when the wasm, zkey
+// and verification key don't belong to the same circuit build
+var ErrIncompatibleArtifacts = errors.New("incompatible circuit artifacts")
+
+// ErrDBPath is returned when the directory of the db backing the Merkle tree
+// can't be created or written
+var ErrDBPath = errors.New("invalid db path")
+
+// ErrEmptyLeaf is returned when a leaf of the Merkle tree was expected to be occupied
+var ErrEmptyLeaf = errors.New("empty leaf")
+
+// ErrLeafConflict is returned when a position of the Merkle tree holds a leaf
+// different from the one being inserted
+var ErrLeafConflict = errors.New("leaf conflict")
+
+// ErrLimitTooLarge is returned when a user message limit exceeds the maximum supported
+// by the circuit, returned by MaxUserMessageLimit
+var ErrLimitTooLarge = errors.New("user message limit too large")
+
+// ProofSizeError is returned when zerokit generates a proof whose size does not match
+// the expected one, which usually indicates a mismatch with the zerokit version in use
+type ProofSizeError struct {
+	Got  int
+	Want int
+}
+
+func (e *ProofSizeError) Error() string {
+	return fmt.Sprintf("invalid proof generated. size: %d expected: %d", e.Got, e.Want)
+}
+
+// ErrResourcesNotFound is returned when one of the circuit artifacts for a tree
+// depth is missing or can't be read
+type ErrResourcesNotFound struct {
+	Depth TreeDepth
+	Path  string
+	Err   error
+}
+
+func (e *ErrResourcesNotFound) Error() string {
+	return fmt.Sprintf("rln resources for tree depth %d not found at %s: %v", e.Depth, e.Path, e.Err)
+}
+
+func (e *ErrResourcesNotFound) Unwrap() error {
+	return e.Err
+}
+
+// ErrRootMismatch is returned when the root of the Merkle Tree is not the expected one
+type ErrRootMismatch struct {
+	Got  MerkleNode
+	Want MerkleNode
+}
+
+func (e *ErrRootMismatch) Error() string {
+	return fmt.Sprintf("merkle root mismatch. got: %x want: %x", e.Got, e.Want)
+}
@@ -61,6 +61,18 @@ func (i RLNWrapper) PoseidonHash(input []byte) ([]byte, error) {
 	return i.ffi.PoseidonHash(input)
 }
 
+// Hash does not use the RLN instance, so it can be called without creating one
+func Hash(input []byte) ([]byte, error) {
+	var rln *r.RLN
+	return rln.Hash(input)
+}
+
+// PoseidonHash does not use the RLN instance, so it can be called without creating one
+func PoseidonHash(input []byte) ([]byte, error) {
+	var rln *r.RLN
+	return rln.PoseidonHash(input)
+}
+
 func (i RLNWrapper) SetLeaf(index uint, idcommitment []byte) bool {
 	return i.ffi.SetLeaf(index, idcommitment)
 }
@@ -0,0 +1,47 @@
+package rln
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+)
+
+// messageData returns the sha256 hash of the binary encoding of a structured
+// message, used as the data of the proofs over that message
+func messageData(msg encoding.BinaryMarshaler) ([]byte, error) {
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal message: %w", err)
+	}
+
+	h := sha256.Sum256(b)
+	return h[:], nil
+}
+
+// GenerateProofForMessage generates a proof like GenerateProof, using as data the
+// sha256 hash of the binary encoding of `msg`. The encoding must be deterministic
+// so the verifier obtains the same data from the same message
+func (r *RLN) GenerateProofForMessage(
+	msg encoding.BinaryMarshaler,
+	key IdentityCredential,
+	index MembershipIndex,
+	epoch Epoch,
+	messageId uint32) (*RateLimitProof, error) {
+	data, err := messageData(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GenerateProof(data, key, index, epoch, messageId)
+}
+
+// VerifyMessage verifies a proof generated with GenerateProofForMessage, deriving
+// the data from `msg` in the same way. The roots are used like in Verify
+func (r *RLN) VerifyMessage(msg encoding.BinaryMarshaler, proof RateLimitProof, roots ...[32]byte) (bool, error) {
+	data, err := messageData(msg)
+	if err != nil {
+		return false, err
+	}
+
+	return r.Verify(data, proof, roots...)
+}
@@ -0,0 +1,335 @@
+package rln
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EpochWindow defines which epochs are acceptable at a given time: the current
+// epoch, and up to MaxEpochGap epochs before and after it
+type EpochWindow struct {
+	// EpochSize is the length of an epoch in seconds
+	EpochSize uint64
+	// MaxEpochGap is the maximum difference allowed between an epoch and the current one
+	MaxEpochGap uint64
+}
+
+// maxEpochGap is the highest MaxEpochGap accepted by Validate. Matching a proof against
+// a window hashes each one of its 2*MaxEpochGap+1 epochs
+const maxEpochGap = 1 << 16
+
+// Validate checks that the epoch size is not 0 and that MaxEpochGap is not above 65536,
+// which the functions computing epochs from the window require
+func (w EpochWindow) Validate() error {
+	if w.EpochSize == 0 {
+		return errors.New("epoch size must be greater than 0")
+	}
+
+	if w.MaxEpochGap > maxEpochGap {
+		return fmt.Errorf("max epoch gap %d is above %d", w.MaxEpochGap, maxEpochGap)
+	}
+
+	return nil
+}
+
+// Contains checks whether the epoch is acceptable at the time `now`. The window
+// must be valid, see Validate
+func (w EpochWindow) Contains(epoch Epoch, now time.Time) bool {
+	gap := Diff(epoch, CalcEpoch(now, w.EpochSize))
+	if gap < 0 {
+		gap = -gap
+	}
+	return uint64(gap) <= w.MaxEpochGap
+}
+
+// Epochs returns the epochs that are acceptable at the time `now`, from the oldest to the
+// newest. The window must be valid, see Validate
+func (w EpochWindow) Epochs(now time.Time) []Epoch {
+	current := CalcEpoch(now, w.EpochSize).Uint64()
+
+	oldest := uint64(0)
+	if current > w.MaxEpochGap {
+		oldest = current - w.MaxEpochGap
+	}
+
+	var result []Epoch
+	for e := oldest; e <= current+w.MaxEpochGap; e++ {
+		result = append(result, ToEpoch(e))
+	}
+	return result
+}
+
+// NullifierLog keeps track of the proofs seen per epoch and nullifier, in order to
+// detect members sending more messages than allowed in an epoch. It is safe for
+// concurrent use
+type NullifierLog struct {
+	mu      sync.Mutex
+	entries map[Epoch]map[Nullifier]RateLimitProof
+}
+
+// NewNullifierLog creates an empty NullifierLog
+func NewNullifierLog() *NullifierLog {
+	return &NullifierLog{
+		entries: make(map[Epoch]map[Nullifier]RateLimitProof),
+	}
+}
+
+// Add records the proof for the epoch. If a proof with the same nullifier was already
+// recorded for the epoch, it is returned and the log is not modified
+func (l *NullifierLog) Add(epoch Epoch, proof RateLimitProof) (*RateLimitProof, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	nullifiers, ok := l.entries[epoch]
+	if !ok {
+		nullifiers = make(map[Nullifier]RateLimitProof)
+		l.entries[epoch] = nullifiers
+	}
+
+	if previous, ok := nullifiers[proof.Nullifier]; ok {
+		return &previous, true
+	}
+
+	nullifiers[proof.Nullifier] = proof
+	return nil, false
+}
+
+// Prune removes the proofs recorded for epochs older than `oldest`
+func (l *NullifierLog) Prune(oldest Epoch) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for epoch := range l.entries {
+		if Diff(epoch, oldest) < 0 {
+			delete(l.entries, epoch)
+		}
+	}
+}
+
+// Len returns the amount of proofs recorded
+func (l *NullifierLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := 0
+	for _, nullifiers := range l.entries {
+		count += len(nullifiers)
+	}
+	return count
+}
+
+// nullifierLogEntrySize is the size of an entry of a serialized NullifierLog
+// [ epoch<32> | proof<288> ]
+const nullifierLogEntrySize = 32 + rateLimitProofSize
+
+// Snapshot serializes the proofs recorded along with their epoch, so the log can be
+// restored with RestoreNullifierLog after a restart, with the following format
+// [ num_entries<8> | entries<var> ], where each entry is [ epoch<32> | proof<288> ]
+func (l *NullifierLog) Snapshot() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := 0
+	for _, nullifiers := range l.entries {
+		count += len(nullifiers)
+	}
+
+	output := make([]byte, 8, 8+count*nullifierLogEntrySize)
+	binary.LittleEndian.PutUint64(output, uint64(count))
+	for epoch, nullifiers := range l.entries {
+		for _, proof := range nullifiers {
+			output = append(output, epoch[:]...)
+			output = append(output, proof.serialize()...)
+		}
+	}
+	return output
+}
+
+// RestoreNullifierLog creates a NullifierLog with the proofs of a snapshot created
+// with NullifierLog.Snapshot, each of them recorded for its original epoch
+func RestoreNullifierLog(b []byte) (*NullifierLog, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("wrong input size expected at least: 8, current: %d", len(b))
+	}
+
+	count := binary.LittleEndian.Uint64(b[:8])
+	b = b[8:]
+
+	if uint64(len(b))%nullifierLogEntrySize != 0 || uint64(len(b))/nullifierLogEntrySize != count {
+		return nil, fmt.Errorf("wrong input size for %d entries: %d", count, len(b))
+	}
+
+	l := NewNullifierLog()
+	for i := 0; i < int(count); i++ {
+		entry := b[i*nullifierLogEntrySize : (i+1)*nullifierLogEntrySize]
+
+		var epoch Epoch
+		copy(epoch[:], entry[:32])
+
+		var proof RateLimitProof
+		if err := proof.deserialize(entry[32:]); err != nil {
+			return nil, err
+		}
+
+		if _, seen := l.Add(epoch, proof); seen {
+			return nil, fmt.Errorf("duplicated nullifier in entry %d", i)
+		}
+	}
+
+	return l, nil
+}
+
+// CheckResult is the outcome of checking a message with a RateLimiter
+type CheckResult int
+
+const (
+	// CheckAllowed indicates the message is valid and within the rate limit
+	CheckAllowed CheckResult = iota
+	// CheckInvalid indicates the proof is not valid for the message and the current root
+	CheckInvalid
+	// CheckOutOfWindow indicates the proof was not generated for any epoch in the window
+	CheckOutOfWindow
+	// CheckDuplicate indicates the same message was already seen
+	CheckDuplicate
+	// CheckSpam indicates the member sent more messages than allowed in the epoch
+	CheckSpam
+)
+
+func (c CheckResult) String() string {
+	switch c {
+	case CheckAllowed:
+		return "allowed"
+	case CheckInvalid:
+		return "invalid"
+	case CheckOutOfWindow:
+		return "out of window"
+	case CheckDuplicate:
+		return "duplicate"
+	case CheckSpam:
+		return "spam"
+	default:
+		return fmt.Sprintf("CheckResult(%d)", int(c))
+	}
+}
+
+// RateLimiter applies the relay policy to incoming messages: the proof must have been
+// generated for an epoch within the window and be valid for the current root of the
+// tree, and each nullifier can only be used once per epoch
+type RateLimiter struct {
+	r      *RLN
+	log    *NullifierLog
+	window EpochWindow
+}
+
+// NewRateLimiter creates a RateLimiter that verifies proofs with `r` and records them in
+// `log`. An error is returned if the window is not valid
+func NewRateLimiter(r *RLN, log *NullifierLog, window EpochWindow) (*RateLimiter, error) {
+	if err := window.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		r:      r,
+		log:    log,
+		window: window,
+	}, nil
+}
+
+// Check decides whether the message should be relayed at the time `now`. When the member
+// sent two different messages with the same nullifier, the result is CheckSpam and the
+// evidence needed to slash the member is returned
+func (rl *RateLimiter) Check(data []byte, proof RateLimitProof, now time.Time) (CheckResult, *SlashingEvidence, error) {
+	epochs := rl.window.Epochs(now)
+
+	epoch, ok, err := rl.r.matchEpoch(proof, epochs)
+	if err != nil {
+		return CheckInvalid, nil, err
+	}
+	if !ok {
+		return CheckOutOfWindow, nil, nil
+	}
+
+	root, err := rl.r.GetMerkleRoot()
+	if err != nil {
+		return CheckInvalid, nil, err
+	}
+
+	verified, err := rl.r.Verify(data, proof, root)
+	if err != nil {
+		return CheckInvalid, nil, err
+	}
+	if !verified {
+		return CheckInvalid, nil, nil
+	}
+
+	rl.log.Prune(epochs[0])
+
+	previous, seen := rl.log.Add(epoch, proof)
+	if !seen {
+		return CheckAllowed, nil, nil
+	}
+
+	if previous.ShareX == proof.ShareX && previous.ShareY == proof.ShareY {
+		return CheckDuplicate, nil, nil
+	}
+
+	evidence, err := rl.r.RecoverSlashingEvidence(*previous, proof)
+	if err != nil {
+		return CheckSpam, nil, err
+	}
+
+	return CheckSpam, evidence, nil
+}
+
+// VerifyWithEpoch verifies the proof like Verify, after checking that the epoch claimed
+// by the sender is within the window at the time `now`, and that the proof was generated
+// for that epoch. It returns ErrEpochOutOfWindow or ErrExternalNullifierMismatch if not,
+// and an error if the window is not valid
+func (r *RLN) VerifyWithEpoch(data []byte, proof RateLimitProof, claimedEpoch Epoch, window EpochWindow, now time.Time, roots ...[32]byte) (bool, error) {
+	if err := window.Validate(); err != nil {
+		return false, err
+	}
+
+	if !window.Contains(claimedEpoch, now) {
+		return false, ErrEpochOutOfWindow
+	}
+
+	rlnIdentifier := r.rlnIdentifier()
+	externalNullifier, err := r.Poseidon(claimedEpoch[:], rlnIdentifier[:])
+	if err != nil {
+		return false, fmt.Errorf("could not construct the external nullifier: %w", err)
+	}
+
+	return r.VerifyExpectingNullifier(data, proof, externalNullifier, roots...)
+}
+
+// MatchEpochWindow recovers the epoch the proof was generated for, by checking the
+// external nullifier of every epoch acceptable at the time `now` against the one in the
+// proof. It returns false if the proof was not generated for any of them, and an error
+// if the window is not valid
+func (r *RLN) MatchEpochWindow(proof RateLimitProof, now time.Time, window EpochWindow) (Epoch, bool, error) {
+	if err := window.Validate(); err != nil {
+		return Epoch{}, false, err
+	}
+
+	return r.matchEpoch(proof, window.Epochs(now))
+}
+
+// matchEpoch returns the epoch among `epochs` the proof was generated for, by
+// comparing the external nullifier of each epoch with the one in the proof
+func (r *RLN) matchEpoch(proof RateLimitProof, epochs []Epoch) (Epoch, bool, error) {
+	rlnIdentifier := r.rlnIdentifier()
+	for _, epoch := range epochs {
+		externalNullifier, err := r.Poseidon(epoch[:], rlnIdentifier[:])
+		if err != nil {
+			return Epoch{}, false, fmt.Errorf("could not construct the external nullifier: %w", err)
+		}
+		if externalNullifier == proof.ExternalNullifier {
+			return epoch, true, nil
+		}
+	}
+	return Epoch{}, false, nil
+}
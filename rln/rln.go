@@ -2,10 +2,20 @@ package rln
 
 import "C"
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/waku-org/go-zerokit-rln/rln/link"
 )
@@ -19,6 +29,77 @@ var DEFAULT_USER_MESSAGE_LIMIT = uint32(10)
 // RLN represents the context used for rln.
 type RLN struct {
 	w *link.RLNWrapper
+
+	// depth is the depth of the Merkle tree
+	depth TreeDepth
+
+	// artifactsHash is the hash of the circuit artifacts the instance was created
+	// with. It is nil when the artifacts embedded in zerokit are used
+	artifactsHash *[32]byte
+
+	// identifier overrides RLN_IDENTIFIER. It can only be set
+	// with the `rln_testhooks` build tag
+	identifier *RLNIdentifier
+
+	// signalHasher transforms the signal before passing it to zerokit. If nil,
+	// the signal is used as it is
+	signalHasher SignalHasher
+
+	// tombstone is the leaf written in place of deleted members. If zero,
+	// deleted members are replaced with zero leaves
+	tombstone MerkleNode
+
+	// userMessageLimit is the user message limit used by the key generation when
+	// none is given. If 0, DEFAULT_USER_MESSAGE_LIMIT is used
+	userMessageLimit uint32
+
+	// insertMu serializes reading the next index and inserting the leaf there in
+	// InsertMemberReturningIndex, so concurrent callers get different indices
+	insertMu sync.Mutex
+
+	// limits keeps the user message limit used for the leaves inserted
+	// with a limit. It is kept in memory only
+	limitsMu sync.Mutex
+	limits   map[MembershipIndex]memberLimit
+}
+
+// memberLimit is the user message limit of a member, along with the leaf that
+// was inserted for it, to detect whether the leaf was replaced afterwards
+type memberLimit struct {
+	leaf  MerkleNode
+	limit uint32
+}
+
+// Names of the circuit artifacts found inside each resources folder
+const (
+	wasmFile     = "rln.wasm"
+	zkeyFile     = "rln_final.zkey"
+	verifKeyFile = "verification_key.json"
+)
+
+// rlnIdentifier returns the RLN identifier used to construct the external nullifiers
+func (r *RLN) rlnIdentifier() RLNIdentifier {
+	if r.identifier != nil {
+		return *r.identifier
+	}
+	return RLN_IDENTIFIER
+}
+
+// signal returns the data passed to zerokit as the signal of a message
+func (r *RLN) signal(data []byte) []byte {
+	if r.signalHasher == nil {
+		return data
+	}
+	return r.signalHasher(data)
+}
+
+// recoverFFI converts a panic raised while calling into zerokit into an error
+// wrapping ErrInternal, so a malformed input can't bring down the whole process.
+// It must be deferred with a pointer to the named error result of the caller
+func recoverFFI(op string, err *error) {
+	if p := recover(); p != nil {
+		*err = fmt.Errorf("%w: %s: %v", ErrInternal, op, p)
+	}
 }
 
 func getResourcesFolder(depth TreeDepth) string {
@@ -31,11 +112,21 @@ func NewRLN() (*RLN, error) {
 	return NewWithConfig(DefaultTreeDepth, nil)
 }
 
+// wasmMagic is the preamble every webassembly module starts with
+var wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
 // NewRLNWithParams generates an instance of RLN. An instance supports both zkSNARKs logics
-// and Merkle tree data structure and operations. The parameter `depth“ indicates the depth of Merkle tree
-func NewRLNWithParams(depth int, wasm []byte, zkey []byte, verifKey []byte, treeConfig *TreeConfig) (*RLN, error) {
-	r := &RLN{}
-	var err error
+// and Merkle tree data structure and operations. The parameter `depth“ indicates the depth of Merkle tree.
+func NewRLNWithParams(depth int, wasm []byte, zkey []byte, verifKey []byte, treeConfig *TreeConfig) (_ *RLN, err error) {
+	defer recoverFFI("NewRLNWithParams", &err)
+
+	if treeConfig != nil && treeConfig.Path != "" {
+		if err := checkDBPath(treeConfig.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &RLN{depth: TreeDepth(depth)}
 
 	treeConfigBytes := []byte{}
 	if treeConfig != nil {
@@ -50,14 +141,89 @@ func NewRLNWithParams(depth int, wasm []byte, zkey []byte, verifKey []byte, tree
 		return nil, err
 	}
 
+	artifactsHash := sha256.Sum256(bytes.Join([][]byte{LengthPrefix(wasm), LengthPrefix(zkey), LengthPrefix(verifKey)}, nil))
+	r.artifactsHash = &artifactsHash
+
+	if err := r.initialize(treeConfig); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewRLNWithParamsChecked generates an instance of RLN like NewRLNWithParams, after
+// checking that the wasm is a webassembly module, and then checks that the artifacts
+// belong to the same circuit build by running SelfTest, which generates and verifies
+// a proof. ErrIncompatibleArtifacts is returned if any of the checks fails. The proof
+// makes the construction take as long as a proof generation and a verification
+func NewRLNWithParamsChecked(depth int, wasm []byte, zkey []byte, verifKey []byte, treeConfig *TreeConfig) (*RLN, error) {
+	if !bytes.HasPrefix(wasm, wasmMagic) {
+		return nil, fmt.Errorf("%w: wasm is not a webassembly module", ErrIncompatibleArtifacts)
+	}
+
+	r, err := NewRLNWithParams(depth, wasm, zkey, verifKey, treeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.SelfTest(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIncompatibleArtifacts, err)
+	}
+
 	return r, nil
 }
 
+// CircuitFingerprint returns a hash identifying the circuit artifacts used by the
+// instance, to compare the circuits run by different nodes. For instances created
+// with NewRLNWithParams or a ResourcesPath, it is the sha256 hash of the length
+// prefixed wasm, zkey and verification key. The artifacts embedded in zerokit can't
+// be read, so for those it is the hash of the tree depth and the version and checksum
+// of the zerokit module they are embedded in
+func (r *RLN) CircuitFingerprint() ([32]byte, error) {
+	if r.artifactsHash != nil {
+		return *r.artifactsHash, nil
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return [32]byte{}, errors.New("build information is not available")
+	}
+
+	for _, dep := range buildInfo.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		if strings.HasPrefix(dep.Path, zerokitModulePrefix) {
+			id := fmt.Sprintf("%s|%s@%s|%s", getResourcesFolder(r.depth), dep.Path, dep.Version, dep.Sum)
+			return sha256.Sum256([]byte(id)), nil
+		}
+	}
+
+	return [32]byte{}, errors.New("zerokit module not found in build information")
+}
+
+// zerokitModulePrefix is the prefix of the modules that contain the zerokit
+// library for each platform
+const zerokitModulePrefix = "github.com/waku-org/go-zerokit-rln-"
+
 // NewWithConfig generates an instance of RLN. An instance supports both zkSNARKs logics
-// and Merkle tree data structure and operations. The parameter `depth` indicates the depth of Merkle tree
-func NewWithConfig(depth TreeDepth, treeConfig *TreeConfig) (*RLN, error) {
-	r := &RLN{}
-	var err error
+// and Merkle tree data structure and operations. The parameter `depth` indicates the depth of Merkle tree.
+// If `treeConfig` has a ResourcesPath, the circuit artifacts are loaded from
+// `ResourcesPath/tree_height_N` instead of using the ones embedded in zerokit
+func NewWithConfig(depth TreeDepth, treeConfig *TreeConfig) (_ *RLN, err error) {
+	defer recoverFFI("NewWithConfig", &err)
+
+	if treeConfig != nil && treeConfig.ResourcesPath != "" {
+		return newWithResourcesPath(depth, treeConfig)
+	}
+
+	if treeConfig != nil && treeConfig.Path != "" {
+		if err := checkDBPath(treeConfig.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &RLN{depth: depth}
 
 	configBytes, err := json.Marshal(config{
 		ResourcesFolder: getResourcesFolder(depth),
@@ -72,10 +238,143 @@ func NewWithConfig(depth TreeDepth, treeConfig *TreeConfig) (*RLN, error) {
 		return nil, err
 	}
 
+	if err := r.initialize(treeConfig); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewFromConfigJSON generates an instance of RLN with a config that is passed verbatim
+// to zerokit, to use settings not modeled by TreeConfig. It must contain the resources
+// folder of the embedded artifacts for `depth`, like `{"resources_folder": "tree_height_20"}`
+func NewFromConfigJSON(depth int, configJSON []byte) (_ *RLN, err error) {
+	defer recoverFFI("NewFromConfigJSON", &err)
+
+	r := &RLN{depth: TreeDepth(depth)}
+
+	r.w, err = link.New(depth, configJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.initialize(nil); err != nil {
+		return nil, err
+	}
+
 	return r, nil
 }
 
-func (r *RLN) SetTree(treeHeight uint) error {
+// initialize completes the construction of an instance once its wrapper was created,
+// applying the settings of treeConfig that are handled in Go and restoring the state
+// stored in the metadata of the tree
+func (r *RLN) initialize(treeConfig *TreeConfig) error {
+	if treeConfig != nil {
+		r.signalHasher = treeConfig.SignalHasher
+	}
+
+	return r.loadTombstone()
+}
+
+// NewRLNWithOptions generates an instance of RLN. An instance supports both zkSNARKs logics
+// and Merkle tree data structure and operations. The parameter `depth` indicates the depth of Merkle tree.
+// The options modify a tree config that has the same defaults zerokit uses
+func NewRLNWithOptions(depth TreeDepth, opts ...TreeOption) (*RLN, error) {
+	if len(opts) == 0 {
+		return NewWithConfig(depth, nil)
+	}
+
+	// defaults used by zerokit for its pmtree config
+	treeConfig := &TreeConfig{
+		CacheCapacity: 150_000,
+		Mode:          HighThroughput,
+		Compression:   false,
+		FlushInterval: 12 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(treeConfig)
+	}
+
+	// without a path, the db would be created in the working directory, so a temporary
+	// one is used instead, as zerokit does when no tree config is given
+	treeConfig.temporary = treeConfig.Path == ""
+
+	return NewWithConfig(depth, treeConfig)
+}
+
+func newWithResourcesPath(depth TreeDepth, treeConfig *TreeConfig) (*RLN, error) {
+	folder := filepath.Join(treeConfig.ResourcesPath, getResourcesFolder(depth))
+
+	wasmPath := filepath.Join(folder, wasmFile)
+	zkeyPath := filepath.Join(folder, zkeyFile)
+	verifKeyPath := filepath.Join(folder, verifKeyFile)
+
+	// check all the artifacts before reading any of them, to report
+	// precisely what is missing
+	for _, path := range []string{wasmPath, zkeyPath, verifKeyPath} {
+		if err := checkReadable(path); err != nil {
+			return nil, &ErrResourcesNotFound{Depth: depth, Path: path, Err: err}
+		}
+	}
+
+	wasm, err := os.ReadFile(wasmPath)
+	if err != nil {
+		return nil, err
+	}
+
+	zkey, err := os.ReadFile(zkeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	verifKey, err := os.ReadFile(verifKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRLNWithParams(int(depth), wasm, zkey, verifKey, treeConfig)
+}
+
+// checkDBPath verifies that the directory of the db exists, creating it if needed,
+// and that files can be created in it
+func checkDBPath(path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrDBPath, err)
+	}
+
+	f, err := os.CreateTemp(path, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDBPath, err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// checkReadable verifies that path is a regular file that can be opened for reading
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	return nil
+}
+
+func (r *RLN) SetTree(treeHeight uint) (err error) {
+	defer recoverFFI("SetTree", &err)
+
 	success := r.w.SetTree(treeHeight)
 	if !success {
 		return errors.New("could not set tree height")
@@ -83,8 +382,74 @@ func (r *RLN) SetTree(treeHeight uint) error {
 	return nil
 }
 
+// initTreeChunkSize is the maximum amount of members InitTreeFromChannel inserts at once
+const initTreeChunkSize = 1000
+
+// InitTreeFromChannel inserts the members received from the channel after the last
+// leaf set in the tree, until the channel is closed. Members are inserted in chunks of
+// those received so far, so they don't need to be buffered. If the context is done,
+// the members already received are inserted and the context error is returned
+func (r *RLN) InitTreeFromChannel(ctx context.Context, ch <-chan IDCommitmentWithLimit) error {
+	index := r.HighWaterMark()
+	chunk := make([]IDCommitmentWithLimit, 0, initTreeChunkSize)
+
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := r.InsertMembersWithLimits(index, chunk); err != nil {
+			return err
+		}
+		index += MembershipIndex(len(chunk))
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for {
+		var member IDCommitmentWithLimit
+		var ok bool
+
+		if len(chunk) == 0 {
+			// wait for the next member
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case member, ok = <-ch:
+			}
+		} else {
+			// insert the pending members if no more are available yet
+			select {
+			case <-ctx.Done():
+				if err := flush(); err != nil {
+					return err
+				}
+				return ctx.Err()
+			case member, ok = <-ch:
+			default:
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if !ok {
+			return flush()
+		}
+
+		chunk = append(chunk, member)
+		if len(chunk) == initTreeChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // Initialize merkle tree with a list of IDCommitments
-func (r *RLN) InitTreeWithMembers(idComms []IDCommitment) error {
+func (r *RLN) InitTreeWithMembers(idComms []IDCommitment) (err error) {
+	defer recoverFFI("InitTreeWithMembers", &err)
+
 	idCommBytes := serializeCommitments(idComms)
 	initSuccess := r.w.InitTreeWithLeaves(idCommBytes)
 	if !initSuccess {
@@ -115,20 +480,57 @@ func toIdentityCredential(generatedKeys []byte, userMessageLimit uint32) (*Ident
 	return key, nil
 }
 
+// maxUserMessageLimit is the largest user message limit supported by the circuit, which
+// range checks the message id and the limit with 16 bits
+const maxUserMessageLimit = uint32(1 << 16)
+
+// MaxUserMessageLimit returns the largest user message limit supported by the circuit.
+// Proofs of members with a larger limit are not valid
+func (r *RLN) MaxUserMessageLimit() uint32 {
+	return maxUserMessageLimit
+}
+
+func checkUserMessageLimit(limit uint32) error {
+	if limit > maxUserMessageLimit {
+		return fmt.Errorf("%w: %d exceeds %d", ErrLimitTooLarge, limit, maxUserMessageLimit)
+	}
+	return nil
+}
+
+// SetDefaultUserMessageLimit sets the user message limit used by MembershipKeyGen and
+// SeededMembershipKeyGen for this instance when no limit is given. Setting it to 0
+// restores DEFAULT_USER_MESSAGE_LIMIT
+func (r *RLN) SetDefaultUserMessageLimit(limit uint32) {
+	r.userMessageLimit = limit
+}
+
+func (r *RLN) defaultUserMessageLimit() uint32 {
+	if r.userMessageLimit == 0 {
+		return DEFAULT_USER_MESSAGE_LIMIT
+	}
+	return r.userMessageLimit
+}
+
 // MembershipKeyGen generates a IdentityCredential that can be used for the
 // registration into the rln membership contract. Returns an error if the key generation fails
 // Accepts an optional parameter that sets the user message limit which defaults
-// to DEFAULT_USER_MESSAGE_LIMIT
-func (r *RLN) MembershipKeyGen(userMessageLimitParam ...uint32) (*IdentityCredential, error) {
+// to the one set with SetDefaultUserMessageLimit, or DEFAULT_USER_MESSAGE_LIMIT
+func (r *RLN) MembershipKeyGen(userMessageLimitParam ...uint32) (_ *IdentityCredential, err error) {
+	defer recoverFFI("MembershipKeyGen", &err)
+
 	var userMessageLimit uint32
 	if len(userMessageLimitParam) == 1 {
 		userMessageLimit = userMessageLimitParam[0]
 	} else if len(userMessageLimitParam) == 0 {
-		userMessageLimit = DEFAULT_USER_MESSAGE_LIMIT
+		userMessageLimit = r.defaultUserMessageLimit()
 	} else {
 		return nil, errors.New("just one user message limit is allowed")
 	}
 
+	if err := checkUserMessageLimit(userMessageLimit); err != nil {
+		return nil, err
+	}
+
 	generatedKeys := r.w.ExtendedKeyGen()
 	if generatedKeys == nil {
 		return nil, errors.New("error in key generation")
@@ -136,21 +538,71 @@ func (r *RLN) MembershipKeyGen(userMessageLimitParam ...uint32) (*IdentityCreden
 	return toIdentityCredential(generatedKeys, userMessageLimit)
 }
 
+// MembershipKeyGenFrom generates an IdentityCredential using a 32 byte seed read from
+// `rand` instead of the random source of zerokit. The same bytes always produce the
+// same credential
+func (r *RLN) MembershipKeyGenFrom(rand io.Reader, limit uint32) (*IdentityCredential, error) {
+	seed := make([]byte, 32)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, fmt.Errorf("could not read the seed: %w", err)
+	}
+
+	return r.SeededMembershipKeyGen(seed, limit)
+}
+
+// DeriveCredential deterministically derives the IdentityCredential at `index` from a
+// master seed, using `seed || index` as the seed of SeededMembershipKeyGen, with the
+// index encoded as a 4 byte little endian value
+func (r *RLN) DeriveCredential(seed []byte, index uint32, limit uint32) (*IdentityCredential, error) {
+	derivedSeed := make([]byte, len(seed), len(seed)+4)
+	copy(derivedSeed, seed)
+	derivedSeed = binary.LittleEndian.AppendUint32(derivedSeed, index)
+
+	return r.SeededMembershipKeyGen(derivedSeed, limit)
+}
+
+// ValidateCredential checks the internal consistency of a credential, by recomputing
+// the secret hash from its trapdoor and nullifier, and the commitment from the secret
+// hash. It returns false if any of them doesn't match the one stored in the credential
+func (r *RLN) ValidateCredential(c IdentityCredential) (bool, error) {
+	secretHash, err := r.Poseidon(c.IDTrapdoor[:], c.IDNullifier[:])
+	if err != nil {
+		return false, err
+	}
+
+	if !IDSecretHashEquals(secretHash, c.IDSecretHash) {
+		return false, nil
+	}
+
+	commitment, err := r.Poseidon(secretHash[:])
+	if err != nil {
+		return false, err
+	}
+
+	return commitment == c.IDCommitment, nil
+}
+
 // SeededMembershipKeyGen generates a deterministic IdentityCredential using a seed
 // that can be used for the registration into the rln membership contract.
 // Returns an error if the key generation fails
 // Accepts an optional parameter that sets the user message limit which defaults
-// to DEFAULT_USER_MESSAGE_LIMIT
-func (r *RLN) SeededMembershipKeyGen(seed []byte, userMessageLimitParam ...uint32) (*IdentityCredential, error) {
+// to the one set with SetDefaultUserMessageLimit, or DEFAULT_USER_MESSAGE_LIMIT
+func (r *RLN) SeededMembershipKeyGen(seed []byte, userMessageLimitParam ...uint32) (_ *IdentityCredential, err error) {
+	defer recoverFFI("SeededMembershipKeyGen", &err)
+
 	var userMessageLimit uint32
 	if len(userMessageLimitParam) == 1 {
 		userMessageLimit = userMessageLimitParam[0]
 	} else if len(userMessageLimitParam) == 0 {
-		userMessageLimit = DEFAULT_USER_MESSAGE_LIMIT
+		userMessageLimit = r.defaultUserMessageLimit()
 	} else {
 		return nil, errors.New("just one user message limit is allowed")
 	}
 
+	if err := checkUserMessageLimit(userMessageLimit); err != nil {
+		return nil, err
+	}
+
 	generatedKeys := r.w.ExtendedSeededKeyGen(seed)
 	if generatedKeys == nil {
 		return nil, errors.New("error in key generation")
@@ -158,26 +610,36 @@ func (r *RLN) SeededMembershipKeyGen(seed []byte, userMessageLimitParam ...uint3
 	return toIdentityCredential(generatedKeys, userMessageLimit)
 }
 
-// appendLength returns length prefixed version of the input with the following format
-// [len<8>|input<var>], the len is a 8 byte value serialized in little endian
-func appendLength(input []byte) []byte {
+// LengthPrefix returns length prefixed version of the input with the following format
+// [len<8>|input<var>], the len is the amount of bytes of the input as a 8 byte value
+// serialized in little endian. This is the format zerokit expects for variable length
+// inputs such as signals and path indexes
+func LengthPrefix(input []byte) []byte {
 	inputLen := make([]byte, 8)
 	binary.LittleEndian.PutUint64(inputLen, uint64(len(input)))
 	return append(inputLen, input...)
 }
 
-// Similar to appendLength but for 32 byte values. The length that is prepended is
-// the length of elements that are 32 bytes long each
-func appendLength32(input []byte) []byte {
+// LengthPrefix32 is similar to LengthPrefix but for a concatenation of 32 byte values,
+// such as roots or id commitments. The len that is prepended, also a 8 byte value in
+// little endian, is the amount of 32 byte elements (len(input)/32), not of bytes
+func LengthPrefix32(input []byte) []byte {
 	inputLen := make([]byte, 8)
 	binary.LittleEndian.PutUint64(inputLen, uint64(len(input)/32))
 	return append(inputLen, input...)
 }
 
 func (r *RLN) Sha256(data []byte) (MerkleNode, error) {
-	lenPrefData := appendLength(data)
+	return Hash(data)
+}
+
+// Hash maps the data to a field element like RLN.Sha256, without creating a RLN instance
+func Hash(data []byte) (_ MerkleNode, err error) {
+	defer recoverFFI("Hash", &err)
+
+	lenPrefData := LengthPrefix(data)
 
-	b, err := r.w.Hash(lenPrefData)
+	b, err := link.Hash(lenPrefData)
 	if err != nil {
 		return MerkleNode{}, err
 	}
@@ -188,7 +650,23 @@ func (r *RLN) Sha256(data []byte) (MerkleNode, error) {
 	return result, nil
 }
 
+// SignalToField returns the field element the circuit uses as signal for `data`, which
+// is the ShareX of the proofs generated for it. The signal hasher configured in the
+// TreeConfig, if any, is applied to the data first. The data is mapped to the field
+// with HashToBN255, like zerokit does
+func (r *RLN) SignalToField(data []byte) (MerkleNode, error) {
+	return HashToBN255(r.signal(data)), nil
+}
+
 func (r *RLN) Poseidon(input ...[]byte) (MerkleNode, error) {
+	return PoseidonHash(input...)
+}
+
+// PoseidonHash calculates the poseidon hash of the inputs like RLN.Poseidon, without
+// creating a RLN instance
+func PoseidonHash(input ...[]byte) (_ MerkleNode, err error) {
+	defer recoverFFI("PoseidonHash", &err)
+
 	data := serializeSlice(input)
 
 	inputLen := make([]byte, 8)
@@ -196,7 +674,7 @@ func (r *RLN) Poseidon(input ...[]byte) (MerkleNode, error) {
 
 	lenPrefData := append(inputLen, data...)
 
-	b, err := r.w.PoseidonHash(lenPrefData)
+	b, err := link.PoseidonHash(lenPrefData)
 	if err != nil {
 		return MerkleNode{}, err
 	}
@@ -207,6 +685,24 @@ func (r *RLN) Poseidon(input ...[]byte) (MerkleNode, error) {
 	return result, nil
 }
 
+// ProofInputBytes returns the input GenerateProof passes to zerokit for the same
+// parameters, without generating the proof. It is meant to compare the input with
+// the one built by other implementations. The format is described in `serialize`
+func (r *RLN) ProofInputBytes(
+	data []byte,
+	key IdentityCredential,
+	index MembershipIndex,
+	epoch Epoch,
+	messageId uint32) ([]byte, error) {
+	rlnIdentifier := r.rlnIdentifier()
+	externalNullifierInput, err := r.Poseidon(epoch[:], rlnIdentifier[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not construct the external nullifier: %w", err)
+	}
+
+	return serialize(key.IDSecretHash, index, key.UserMessageLimit, messageId, externalNullifierInput, r.signal(data)), nil
+}
+
 // GenerateProof generates a proof for the RLN given a KeyPair and the index in a merkle tree.
 // The output will containt the proof data and should be parsed as |proof<128>|root<32>|epoch<32>|share_x<32>|share_y<32>|nullifier<32>|
 // integers wrapped in <> indicate value sizes in bytes
@@ -215,59 +711,73 @@ func (r *RLN) GenerateProof(
 	key IdentityCredential,
 	index MembershipIndex,
 	epoch Epoch,
-	messageId uint32) (*RateLimitProof, error) {
+	messageId uint32) (_ *RateLimitProof, err error) {
+	defer recoverFFI("GenerateProof", &err)
 
-	externalNullifierInput, err := r.Poseidon(epoch[:], RLN_IDENTIFIER[:])
+	input, err := r.ProofInputBytes(data, key, index, epoch, messageId)
 	if err != nil {
-		return nil, fmt.Errorf("could not construct the external nullifier: %w", err)
+		return nil, err
 	}
 
-	input := serialize(key.IDSecretHash, index, key.UserMessageLimit, messageId, externalNullifierInput, data)
 	proofBytes, err := r.w.GenerateRLNProof(input)
 	if err != nil {
 		return nil, err
 	}
 
-	expectedBytes := 288
-	if len(proofBytes) != expectedBytes {
-		return nil, fmt.Errorf("invalid proof generated. size: %d expected: %d",
-			len(proofBytes), expectedBytes)
+	if len(proofBytes) != rateLimitProofSize {
+		return nil, &ProofSizeError{Got: len(proofBytes), Want: rateLimitProofSize}
 	}
 
 	// parse proof taken from: https://github.com/vacp2p/zerokit/blob/v0.5.0/rln/src/public.rs#L750
-	// [ proof<128> | root<32> | external_nullifier<32> | x<32> | y<32> | nullifier<32>]
-	proofOffset := 128
-	rootOffset := proofOffset + 32
-	externalNullifierOffset := rootOffset + 32
-	shareXOffset := externalNullifierOffset + 32
-	shareYOffset := shareXOffset + 32
-	nullifierOffset := shareYOffset + 32
-
-	var zkproof ZKSNARK
-	var proofRoot, shareX, shareY MerkleNode
-	var externalNullifier Nullifier
-	var nullifier Nullifier
-
-	copy(zkproof[:], proofBytes[0:proofOffset])
-	copy(proofRoot[:], proofBytes[proofOffset:rootOffset])
-	copy(externalNullifier[:], proofBytes[rootOffset:externalNullifierOffset])
-	copy(shareX[:], proofBytes[externalNullifierOffset:shareXOffset])
-	copy(shareY[:], proofBytes[shareXOffset:shareYOffset])
-	copy(nullifier[:], proofBytes[shareYOffset:nullifierOffset])
-
-	return &RateLimitProof{
-		Proof:             zkproof,
-		MerkleRoot:        proofRoot,
-		ExternalNullifier: externalNullifier,
-		ShareX:            shareX,
-		ShareY:            shareY,
-		Nullifier:         nullifier,
-	}, nil
+	proof := &RateLimitProof{}
+	if err := proof.deserialize(proofBytes); err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// GenerateProofTimeout generates a proof like GenerateProof, but returns ctx.Err()
+// if the context is done before the proof is ready. The call into zerokit can't be
+// interrupted, so it keeps running in the background until it finishes, and its
+// result is discarded
+func (r *RLN) GenerateProofTimeout(
+	ctx context.Context,
+	data []byte,
+	key IdentityCredential,
+	index MembershipIndex,
+	epoch Epoch,
+	messageId uint32) (*RateLimitProof, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		proof *RateLimitProof
+		err   error
+	}
+
+	// buffered so the goroutine can always exit even if nobody is reading
+	ch := make(chan result, 1)
+	go func() {
+		proof, err := r.GenerateProof(data, key, index, epoch, messageId)
+		ch <- result{proof, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.proof, res.err
+	}
 }
 
 // Returns a RLN proof with a custom witness, so no tree is required in the RLN instance
-// to calculate such proof. The witness can be created with GetMerkleProof data.
-func (r *RLN) GenerateRLNProofWithWitness(witness RLNWitnessInput) (*RateLimitProof, error) {
+// to calculate such proof. The witness can be created with GetMerkleProof data, which
+// may come from a different instance: the tree of this instance can be empty.
+func (r *RLN) GenerateRLNProofWithWitness(witness RLNWitnessInput) (_ *RateLimitProof, err error) {
+	defer recoverFFI("GenerateRLNProofWithWitness", &err)
+
 	// serialized as: https://github.com/vacp2p/zerokit/blob/v0.5.0/rln/src/protocol.rs#L127
 	// input [ id_secret_hash<32> | user_message_limit<32> | message_id<32> | num_elements<8> | path_elements<var1> | num_indexes<8> | path_indexes<var2> | external_nullifier<32> ]
 	proofBytes, err := r.w.GenerateRLNProofWithWitness(witness.serialize())
@@ -275,41 +785,17 @@ func (r *RLN) GenerateRLNProofWithWitness(witness RLNWitnessInput) (*RateLimitPr
 		return nil, err
 	}
 
-	expectedBytes := 288
-	if len(proofBytes) != expectedBytes {
-		return nil, fmt.Errorf("invalid proof generated. size: %d expected: %d",
-			len(proofBytes), expectedBytes)
+	if len(proofBytes) != rateLimitProofSize {
+		return nil, &ProofSizeError{Got: len(proofBytes), Want: rateLimitProofSize}
 	}
 
 	// parse proof taken from: https://github.com/vacp2p/zerokit/blob/v0.5.0/rln/src/public.rs#L750
-	// [ proof<128> | root<32> | external_nullifier<32> | x<32> | y<32> | nullifier<32>]
-	proofOffset := 128
-	rootOffset := proofOffset + 32
-	externalNullifierOffset := rootOffset + 32
-	shareXOffset := externalNullifierOffset + 32
-	shareYOffset := shareXOffset + 32
-	nullifierOffset := shareYOffset + 32
-
-	var zkproof ZKSNARK
-	var proofRoot, shareX, shareY MerkleNode
-	var externalNullifier Nullifier
-	var nullifier Nullifier
-
-	copy(zkproof[:], proofBytes[0:proofOffset])
-	copy(proofRoot[:], proofBytes[proofOffset:rootOffset])
-	copy(externalNullifier[:], proofBytes[rootOffset:externalNullifierOffset])
-	copy(shareX[:], proofBytes[externalNullifierOffset:shareXOffset])
-	copy(shareY[:], proofBytes[shareXOffset:shareYOffset])
-	copy(nullifier[:], proofBytes[shareYOffset:nullifierOffset])
-
-	return &RateLimitProof{
-		Proof:             zkproof,
-		MerkleRoot:        proofRoot,
-		ExternalNullifier: externalNullifier,
-		ShareX:            shareX,
-		ShareY:            shareY,
-		Nullifier:         nullifier,
-	}, nil
+	proof := &RateLimitProof{}
+	if err := proof.deserialize(proofBytes); err != nil {
+		return nil, err
+	}
+
+	return proof, nil
 }
 
 func (r *RLN) CreateWitness(
@@ -320,7 +806,8 @@ func (r *RLN) CreateWitness(
 	epoch [32]byte,
 	merkleProof MerkleProof) (RLNWitnessInput, error) {
 
-	externalNullifier, err := r.Poseidon(epoch[:], RLN_IDENTIFIER[:])
+	rlnIdentifier := r.rlnIdentifier()
+	externalNullifier, err := r.Poseidon(epoch[:], rlnIdentifier[:])
 	if err != nil {
 		return RLNWitnessInput{}, fmt.Errorf("could not construct the external nullifier: %w", err)
 	}
@@ -330,7 +817,7 @@ func (r *RLN) CreateWitness(
 		UserMessageLimit:  userMessageLimit,
 		MessageId:         messageId,
 		MerkleProof:       merkleProof,
-		X:                 HashToBN255(data),
+		X:                 HashToBN255(r.signal(data)),
 		ExternalNullifier: externalNullifier,
 	}, nil
 }
@@ -343,6 +830,24 @@ func serialize32(roots [][32]byte) []byte {
 	return result
 }
 
+// serializeRoots serializes the roots accepted by a verification, skipping
+// duplicates. Every root must be a valid field element
+func serializeRoots(roots [][32]byte) ([]byte, error) {
+	seen := make(map[[32]byte]struct{}, len(roots))
+	unique := make([][32]byte, 0, len(roots))
+	for i, root := range roots {
+		if !isFieldElement(root) {
+			return nil, fmt.Errorf("%w: root %d is not a valid field element", ErrInvalidRoot, i)
+		}
+		if _, ok := seen[root]; ok {
+			continue
+		}
+		seen[root] = struct{}{}
+		unique = append(unique, root)
+	}
+	return serialize32(unique), nil
+}
+
 func serializeSlice(roots [][]byte) []byte {
 	var result []byte
 	for _, r := range roots {
@@ -385,9 +890,19 @@ func serializeIndices(indices []MembershipIndex) []byte {
 // proof [ proof<128>| root<32>| epoch<32>| share_x<32>| share_y<32>| nullifier<32> | signal_len<8> | signal<var> ]
 // validRoots should contain a sequence of roots in the acceptable windows.
 // As default, it is set to an empty sequence of roots. This implies that the validity check for the proof's root is skipped
-func (r *RLN) Verify(data []byte, proof RateLimitProof, roots ...[32]byte) (bool, error) {
-	proofBytes := proof.serializeWithData(data)
-	rootBytes := serialize32(roots)
+func (r *RLN) Verify(data []byte, proof RateLimitProof, roots ...[32]byte) (_ bool, err error) {
+	defer recoverFFI("Verify", &err)
+
+	if err := proof.Validate(); err != nil {
+		return false, err
+	}
+
+	rootBytes, err := serializeRoots(roots)
+	if err != nil {
+		return false, err
+	}
+
+	proofBytes := proof.serializeWithData(r.signal(data))
 
 	res, err := r.w.VerifyWithRoots(proofBytes, rootBytes)
 	if err != nil {
@@ -397,119 +912,878 @@ func (r *RLN) Verify(data []byte, proof RateLimitProof, roots ...[32]byte) (bool
 	return res, nil
 }
 
-// RecoverIDSecret returns an IDSecret having obtained before two proofs
-func (r *RLN) RecoverIDSecret(proof1 RateLimitProof, proof2 RateLimitProof) (IDSecretHash, error) {
-	proof1Bytes := proof1.serialize()
-	proof2Bytes := proof2.serialize()
-	secret, err := r.w.RecoverIDSecret(proof1Bytes, proof2Bytes)
-	if err != nil {
-		return IDSecretHash{}, err
+// VerifyExpectingNullifier verifies the proof like Verify, but first checks that the
+// proof was generated for the expected external nullifier, returning
+// ErrExternalNullifierMismatch if it was not
+func (r *RLN) VerifyExpectingNullifier(data []byte, proof RateLimitProof, expected Nullifier, roots ...[32]byte) (bool, error) {
+	if proof.ExternalNullifier != expected {
+		return false, ErrExternalNullifierMismatch
 	}
-	var result IDSecretHash
-	copy(result[:], secret)
-	return result, nil
-}
 
-// InsertMember adds the member to the tree. The leaf is made of
-// the id commitment and the user message limit
-func (r *RLN) InsertMember(idComm IDCommitment, userMessageLimit uint32) error {
-	userMessageLimitBytes := SerializeUint32(userMessageLimit)
+	return r.Verify(data, proof, roots...)
+}
 
-	hashedLeaf, err := r.Poseidon(idComm[:], userMessageLimitBytes[:])
+// GenerateProofHashedSignal generates a proof for the sha256 hash of data reduced to a
+// field element instead of data itself. Proofs generated with this function must be
+// verified with VerifyHashedSignal
+func (r *RLN) GenerateProofHashedSignal(
+	data []byte,
+	key IdentityCredential,
+	index MembershipIndex,
+	epoch Epoch,
+	messageId uint32) (*RateLimitProof, error) {
+	signal, err := r.Sha256(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash the signal: %w", err)
+	}
+
+	return r.GenerateProof(signal[:], key, index, epoch, messageId)
+}
+
+// VerifyHashedSignal verifies a proof generated with GenerateProofHashedSignal, applying
+// the same reduction to data before the verification
+func (r *RLN) VerifyHashedSignal(data []byte, proof RateLimitProof, roots ...[32]byte) (bool, error) {
+	signal, err := r.Sha256(data)
+	if err != nil {
+		return false, fmt.Errorf("could not hash the signal: %w", err)
+	}
+
+	return r.Verify(signal[:], proof, roots...)
+}
+
+// BatchVerifyPerItemRoots verifies multiple proofs, each one of them against its own set
+// of valid roots. The result indicates for each item whether its proof is valid or not
+func (r *RLN) BatchVerifyPerItemRoots(items []VerifyItemWithRoots) ([]bool, error) {
+	result := make([]bool, len(items))
+	for i, item := range items {
+		verified, err := r.Verify(item.Data, item.Proof, item.Roots...)
+		if err != nil {
+			return nil, fmt.Errorf("could not verify item %d: %w", i, err)
+		}
+		result[i] = verified
+	}
+	return result, nil
+}
+
+// BatchVerifySameRoot verifies multiple proofs that must have been generated against
+// `root`. Items whose MerkleRoot is different, or whose proof is malformed, are reported
+// as invalid without verifying the zk proof, so a single bad item does not prevent the
+// others from being verified. The result indicates for each item whether its proof is
+// valid or not
+func (r *RLN) BatchVerifySameRoot(items []VerifyItem, root MerkleNode) ([]bool, error) {
+	verifier, err := r.NewVerifier([][32]byte{root})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]bool, len(items))
+	for i, item := range items {
+		if item.Proof.MerkleRoot != root || item.Proof.Validate() != nil {
+			continue
+		}
+
+		verified, err := verifier.Verify(item.Data, item.Proof)
+		if err != nil {
+			return nil, fmt.Errorf("could not verify item %d: %w", i, err)
+		}
+		result[i] = verified
+	}
+	return result, nil
+}
+
+// Verifier verifies proofs against a fixed set of valid roots, which are
+// serialized only once when the Verifier is created
+type Verifier struct {
+	r         *RLN
+	rootBytes []byte
+}
+
+// NewVerifier returns a Verifier that accepts proofs whose root is in `roots`. The roots
+// are checked and deduplicated like in Verify, returning ErrInvalidRoot if any of them
+// is not a valid field element. If the set of valid roots changes, a new Verifier must
+// be created
+func (r *RLN) NewVerifier(roots [][32]byte) (*Verifier, error) {
+	rootBytes, err := serializeRoots(roots)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{
+		r:         r,
+		rootBytes: rootBytes,
+	}, nil
+}
+
+// Verify checks the proof against the data and the roots the Verifier was created with
+func (v *Verifier) Verify(data []byte, proof RateLimitProof) (_ bool, err error) {
+	defer recoverFFI("Verifier.Verify", &err)
+
+	if err := proof.Validate(); err != nil {
+		return false, err
+	}
+
+	proofBytes := proof.serializeWithData(v.r.signal(data))
+
+	res, err := v.r.w.VerifyWithRoots(proofBytes, v.rootBytes)
+	if err != nil {
+		return false, err
+	}
+
+	return res, nil
+}
+
+// VerifierRLN is a read-only view over a RLN instance. It only exposes the
+// operations needed to verify proofs, so it can't be used to modify the tree
+type VerifierRLN struct {
+	r *RLN
+}
+
+// ReadOnly returns a read-only view of the RLN instance. Changes done to the
+// tree through the RLN instance are visible in the view
+func (r *RLN) ReadOnly() *VerifierRLN {
+	return &VerifierRLN{r: r}
+}
+
+// Verify checks the proof like RLN.Verify
+func (v *VerifierRLN) Verify(data []byte, proof RateLimitProof, roots ...[32]byte) (bool, error) {
+	return v.r.Verify(data, proof, roots...)
+}
+
+// BatchVerifyPerItemRoots checks multiple proofs like RLN.BatchVerifyPerItemRoots
+func (v *VerifierRLN) BatchVerifyPerItemRoots(items []VerifyItemWithRoots) ([]bool, error) {
+	return v.r.BatchVerifyPerItemRoots(items)
+}
+
+// GetMerkleRoot reads the Merkle Tree root
+func (v *VerifierRLN) GetMerkleRoot() (MerkleNode, error) {
+	return v.r.GetMerkleRoot()
+}
+
+// GetMerkleProof returns the Merkle proof for the element at the specified index
+func (v *VerifierRLN) GetMerkleProof(index MembershipIndex) (MerkleProof, error) {
+	return v.r.GetMerkleProof(index)
+}
+
+// RecoverIDSecret returns an IDSecret having obtained before two proofs
+func (r *RLN) RecoverIDSecret(proof1 RateLimitProof, proof2 RateLimitProof) (_ IDSecretHash, err error) {
+	defer recoverFFI("RecoverIDSecret", &err)
+
+	proof1Bytes := proof1.serialize()
+	proof2Bytes := proof2.serialize()
+	secret, err := r.w.RecoverIDSecret(proof1Bytes, proof2Bytes)
+	if err != nil {
+		return IDSecretHash{}, err
+	}
+	var result IDSecretHash
+	copy(result[:], secret)
+	return result, nil
+}
+
+// hashLeaf calculates the value stored in the merkle tree for a membership,
+// which is the poseidon hash of the id commitment and the user message limit
+func (r *RLN) hashLeaf(idComm IDCommitment, userMessageLimit uint32) (MerkleNode, error) {
+	userMessageLimitBytes := SerializeUint32(userMessageLimit)
+	return r.Poseidon(idComm[:], userMessageLimitBytes[:])
+}
+
+// InsertMember adds the member to the tree. The leaf is made of
+// the id commitment and the user message limit, which can't exceed MaxUserMessageLimit
+func (r *RLN) InsertMember(idComm IDCommitment, userMessageLimit uint32) (err error) {
+	defer recoverFFI("InsertMember", &err)
+
+	_, err = r.InsertMemberReturningIndex(idComm, userMessageLimit)
+	return err
+}
+
+// InsertMemberReturningIndex adds the member to the tree like InsertMember
+// and returns the index where its leaf was placed
+func (r *RLN) InsertMemberReturningIndex(idComm IDCommitment, userMessageLimit uint32) (_ MembershipIndex, err error) {
+	defer recoverFFI("InsertMemberReturningIndex", &err)
+
+	if err := checkUserMessageLimit(userMessageLimit); err != nil {
+		return 0, err
+	}
+
+	hashedLeaf, err := r.hashLeaf(idComm, userMessageLimit)
+	if err != nil {
+		return 0, err
+	}
+
+	r.insertMu.Lock()
+	defer r.insertMu.Unlock()
+
+	// SetNextLeaf places the leaf right after the highest index set
+	index := MembershipIndex(r.w.LeavesSet())
+
+	insertionSuccess := r.w.SetNextLeaf(hashedLeaf[:])
+	if !insertionSuccess {
+		return 0, errors.New("could not insert member")
+	}
+
+	r.setMemberLimit(index, hashedLeaf, userMessageLimit)
+
+	return index, nil
+}
+
+// setMemberLimit records the user message limit used for the leaf at index
+func (r *RLN) setMemberLimit(index MembershipIndex, leaf MerkleNode, limit uint32) {
+	r.limitsMu.Lock()
+	defer r.limitsMu.Unlock()
+
+	if r.limits == nil {
+		r.limits = make(map[MembershipIndex]memberLimit)
+	}
+	r.limits[index] = memberLimit{leaf: leaf, limit: limit}
+}
+
+// GetMemberLimit returns the user message limit used when the member at index was
+// inserted with InsertMember, InsertMemberReturningIndex or InsertMembersWithLimits.
+// The limits are kept in memory only, so they are not available for members inserted
+// before the instance was created, or if the leaf was replaced since then
+func (r *RLN) GetMemberLimit(index MembershipIndex) (uint32, bool, error) {
+	r.limitsMu.Lock()
+	entry, ok := r.limits[index]
+	r.limitsMu.Unlock()
+
+	if !ok {
+		return 0, false, nil
+	}
+
+	leaf, err := r.GetLeaf(index)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if leaf != entry.leaf {
+		return 0, false, nil
+	}
+
+	return entry.limit, true, nil
+}
+
+func (r *RLN) InsertRawLeaf(rawLeaf MerkleNode) (err error) {
+	defer recoverFFI("InsertRawLeaf", &err)
+
+	insertionSuccess := r.w.SetNextLeaf(rawLeaf[:])
+	if !insertionSuccess {
+		return errors.New("could not insert raw leaf")
+	}
+	return nil
+}
+
+// InsertLeafHash sets a precomputed leaf at the specified index, skipping the hashing
+// of the id commitment and the user message limit done by InsertMember. The caller is
+// responsible of the leaf being the poseidon hash of both values, otherwise proofs
+// generated for that membership won't be valid
+func (r *RLN) InsertLeafHash(index MembershipIndex, leaf MerkleNode) (err error) {
+	defer recoverFFI("InsertLeafHash", &err)
+
+	insertionSuccess := r.w.SetLeaf(index, leaf[:])
+	if !insertionSuccess {
+		return errors.New("could not insert leaf hash")
+	}
+	return nil
+}
+
+// Insert multiple members i.e., identity commitments starting from index
+// This proc is atomic, i.e., if any of the insertions fails, all the previous insertions are rolled back
+func (r *RLN) InsertMembers(index MembershipIndex, idComms []IDCommitment) (err error) {
+	defer recoverFFI("InsertMembers", &err)
+
+	idCommBytes := serializeCommitments(idComms)
+	indicesBytes := serializeIndices(nil)
+	insertionSuccess := r.w.AtomicOperation(index, idCommBytes, indicesBytes)
+	if !insertionSuccess {
+		return errors.New("could not insert members")
+	}
+	return nil
+}
+
+// InsertMembersWithLimitFn adds multiple members starting from index like
+// InsertMembersWithLimits, calling `limitFn` to obtain the user message limit of each
+// member. Nothing is inserted if `limitFn` fails for any of them
+func (r *RLN) InsertMembersWithLimitFn(index MembershipIndex, idComms []IDCommitment, limitFn func(idComm IDCommitment) (uint32, error)) error {
+	members := make([]IDCommitmentWithLimit, len(idComms))
+	for i, idComm := range idComms {
+		limit, err := limitFn(idComm)
+		if err != nil {
+			return fmt.Errorf("could not get the user message limit of member %d: %w", i, err)
+		}
+		members[i] = IDCommitmentWithLimit{IDCommitment: idComm, UserMessageLimit: limit}
+	}
+	return r.InsertMembersWithLimits(index, members)
+}
+
+// InsertMembersWithLimits adds multiple members starting from index. The leaf of each
+// member is made of its id commitment and its own user message limit.
+// This proc is atomic, i.e., if any of the insertions fails, all the previous insertions are rolled back
+func (r *RLN) InsertMembersWithLimits(index MembershipIndex, members []IDCommitmentWithLimit) (err error) {
+	defer recoverFFI("InsertMembersWithLimits", &err)
+
+	leaves := make([]IDCommitment, len(members))
+	for i, m := range members {
+		if err := checkUserMessageLimit(m.UserMessageLimit); err != nil {
+			return fmt.Errorf("member %d: %w", i, err)
+		}
+		leaves[i], err = r.hashLeaf(m.IDCommitment, m.UserMessageLimit)
+		if err != nil {
+			return err
+		}
+	}
+
+	leavesBytes := serializeCommitments(leaves)
+	indicesBytes := serializeIndices(nil)
+	insertionSuccess := r.w.AtomicOperation(index, leavesBytes, indicesBytes)
+	if !insertionSuccess {
+		return errors.New("could not insert members")
+	}
+
+	for i, m := range members {
+		r.setMemberLimit(index+MembershipIndex(i), leaves[i], m.UserMessageLimit)
+	}
+
+	return nil
+}
+
+// InsertMembersIdempotent adds multiple members starting from index like
+// InsertMembersWithLimits, skipping the members whose leaf is already at their index, so
+// a sync can be restarted from an earlier point. It returns ErrLeafConflict if the
+// position of a member holds a different leaf. The amount of members that were not
+// present is returned
+func (r *RLN) InsertMembersIdempotent(index MembershipIndex, members []IDCommitmentWithLimit) (inserted int, err error) {
+	numLeaves, err := r.LeavesSetChecked()
+	if err != nil {
+		return 0, err
+	}
+
+	first, last := -1, -1
+	for i, m := range members {
+		position := index + MembershipIndex(i)
+
+		leaf, err := r.hashLeaf(m.IDCommitment, m.UserMessageLimit)
+		if err != nil {
+			return 0, err
+		}
+
+		if position < numLeaves {
+			existing, err := r.GetLeaf(position)
+			if err != nil {
+				return 0, fmt.Errorf("could not get leaf %d: %w", position, err)
+			}
+
+			if existing == leaf {
+				r.setMemberLimit(position, leaf, m.UserMessageLimit)
+				continue
+			}
+
+			if existing != (IDCommitment{}) {
+				return 0, fmt.Errorf("%w: index %d", ErrLeafConflict, position)
+			}
+		}
+
+		if first == -1 {
+			first = i
+		}
+		last = i
+		inserted++
+	}
+
+	if inserted == 0 {
+		return 0, nil
+	}
+
+	// the members already present in between are rewritten with the same leaf
+	err = r.InsertMembersWithLimits(index+MembershipIndex(first), members[first:last+1])
+	if err != nil {
+		return 0, err
+	}
+
+	return inserted, nil
+}
+
+// InsertMembersWithRootCallback adds multiple members starting from index like
+// InsertMembersWithLimits, in batches of `batchSize` members. After each batch `cb` is
+// called with the amount of members inserted so far and the resulting root, to report
+// progress. Each batch is atomic, but the batches already inserted are kept if one fails
+func (r *RLN) InsertMembersWithRootCallback(index MembershipIndex, members []IDCommitmentWithLimit, batchSize int, cb func(processed int, root MerkleNode)) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	for processed := 0; processed < len(members); {
+		end := processed + batchSize
+		if end > len(members) {
+			end = len(members)
+		}
+
+		err := r.InsertMembersWithLimits(index+MembershipIndex(processed), members[processed:end])
+		if err != nil {
+			return fmt.Errorf("could not insert members %d to %d: %w", processed, end, err)
+		}
+		processed = end
+
+		if cb != nil {
+			root, err := r.GetMerkleRoot()
+			if err != nil {
+				return err
+			}
+			cb(processed, root)
+		}
+	}
+
+	return nil
+}
+
+// Insert a member in the tree at specified index
+func (r *RLN) InsertMemberAt(index MembershipIndex, idComm IDCommitment) (err error) {
+	defer recoverFFI("InsertMemberAt", &err)
+
+	insertionSuccess := r.w.SetLeaf(index, idComm[:])
+	if !insertionSuccess {
+		return errors.New("could not insert member")
+	}
+	return nil
+}
+
+// DeleteMember removes an IDCommitment key from the tree. The index
+// parameter is the position of the id commitment key to be deleted from the tree.
+// The deleted id commitment key is replaced with a zero leaf, or with the
+// tombstone if one was set with SetTombstone
+func (r *RLN) DeleteMember(index MembershipIndex) (err error) {
+	defer recoverFFI("DeleteMember", &err)
+
+	if r.tombstone != (MerkleNode{}) {
+		if !r.w.SetLeaf(index, r.tombstone[:]) {
+			return errors.New("could not delete member")
+		}
+		return nil
+	}
+
+	deletionSuccess := r.w.DeleteLeaf(index)
+	if !deletionSuccess {
+		return errors.New("could not delete member")
+	}
+	return nil
+}
+
+// SetTombstone makes the deletions done with this instance write `value` instead of a
+// zero leaf, so the positions of deleted members can be told apart from positions that
+// were never used. The value must be a valid field element that can't be the leaf of a
+// member, e.g. a random one. Setting it to zero restores the zero leaves. It is stored
+// in the metadata of the tree, so it is restored when the tree is loaded from disk
+func (r *RLN) SetTombstone(value MerkleNode) error {
+	if !isFieldElement(value) {
+		return errors.New("tombstone is not a valid field element")
+	}
+
+	metadata, err := r.GetMetadata()
+	if err != nil {
+		return err
+	}
+
+	previous := r.tombstone
+	r.tombstone = value
+	if err := r.SetMetadata(metadata); err != nil {
+		r.tombstone = previous
+		return err
+	}
+
+	return nil
+}
+
+// IsTombstone checks whether the member at `index` was deleted while a tombstone was set
+func (r *RLN) IsTombstone(index MembershipIndex) (bool, error) {
+	if r.tombstone == (MerkleNode{}) {
+		return false, nil
+	}
+
+	leaf, err := r.GetLeaf(index)
+	if err != nil {
+		return false, err
+	}
+
+	return leaf == r.tombstone, nil
+}
+
+// DeleteMemberByCommitment removes a member from the tree using its id commitment
+// and user message limit instead of its index. The tree is scanned to find the
+// leaf, and ErrMemberNotFound is returned if there is no such member
+func (r *RLN) DeleteMemberByCommitment(idComm IDCommitment, userMessageLimit uint32) error {
+	leaf, err := r.hashLeaf(idComm, userMessageLimit)
+	if err != nil {
+		return err
+	}
+
+	index, err := r.findLeaf(leaf)
 	if err != nil {
 		return err
 	}
 
-	insertionSuccess := r.w.SetNextLeaf(hashedLeaf[:])
-	if !insertionSuccess {
-		return errors.New("could not insert member")
-	}
-	return nil
+	return r.DeleteMember(index)
+}
+
+// findLeaf returns the index of the first leaf in the tree matching the value received
+func (r *RLN) findLeaf(leaf MerkleNode) (MembershipIndex, error) {
+	indices, err := r.findLeaves([]MerkleNode{leaf})
+	if err != nil {
+		return 0, err
+	}
+	return indices[0], nil
+}
+
+// findLeaves scans the tree once and returns the index of each one of the leaves
+// received, in the same order. ErrMemberNotFound is returned if any of them is missing
+func (r *RLN) findLeaves(leaves []MerkleNode) ([]MembershipIndex, error) {
+	pending := make(map[MerkleNode][]int)
+	for i, leaf := range leaves {
+		pending[leaf] = append(pending[leaf], i)
+	}
+
+	result := make([]MembershipIndex, len(leaves))
+	numLeaves := r.LeavesSet()
+	for i := MembershipIndex(0); i < numLeaves && len(pending) != 0; i++ {
+		current, err := r.GetLeaf(i)
+		if err != nil {
+			return nil, err
+		}
+
+		positions, ok := pending[current]
+		if !ok {
+			continue
+		}
+
+		// the same leaf could be requested more than once, and it could also
+		// be stored in more than one index
+		result[positions[0]] = i
+		if len(positions) == 1 {
+			delete(pending, current)
+		} else {
+			pending[current] = positions[1:]
+		}
+	}
+
+	if len(pending) != 0 {
+		return nil, ErrMemberNotFound
+	}
+
+	return result, nil
+}
+
+// DeleteMembersByCommitment removes multiple members from the tree using their id
+// commitments and user message limits. The members are removed atomically: if any
+// of them can't be found, ErrMemberNotFound is returned and the tree is not modified
+func (r *RLN) DeleteMembersByCommitment(members []IDCommitmentWithLimit) error {
+	leaves := make([]MerkleNode, len(members))
+	for i, m := range members {
+		leaf, err := r.hashLeaf(m.IDCommitment, m.UserMessageLimit)
+		if err != nil {
+			return err
+		}
+		leaves[i] = leaf
+	}
+
+	indices, err := r.findLeaves(leaves)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.zeroLeaves(indices)
+	return err
+}
+
+// zeroLeaves atomically replaces the leaves at the indices received with zero leaves,
+// or with the tombstone if one was set, and returns the leaves they held before.
+// zerokit's atomic_operation zeroes the wrong leaves when removing more than one index,
+// so each index is written on its own, and if a write fails the leaves already written
+// are restored
+func (r *RLN) zeroLeaves(indices []MembershipIndex) ([]IDCommitment, error) {
+	previous, err := r.GetLeavesByIndex(indices)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, index := range indices {
+		if !r.w.SetLeaf(index, r.tombstone[:]) {
+			err := fmt.Errorf("could not remove leaf %d", index)
+			return nil, withRollback(err, func() error {
+				return r.restoreLeaves(indices[:i], previous[:i])
+			})
+		}
+	}
+
+	return previous, nil
+}
+
+// restoreLeaves writes back the leaves held by `indices` before a change that could not
+// be completed. They are written in reverse order, so an index that appears more than
+// once ends up with the value it had first
+func (r *RLN) restoreLeaves(indices []MembershipIndex, leaves []IDCommitment) error {
+	for i := len(indices) - 1; i >= 0; i-- {
+		if !r.w.SetLeaf(indices[i], leaves[i][:]) {
+			return fmt.Errorf("could not restore leaf %d", indices[i])
+		}
+	}
+	return nil
+}
+
+// withRollback calls revert after a failed change and returns err, along with the
+// error of revert if the change could not be reverted either
+func withRollback(err error, revert func() error) error {
+	if rollbackErr := revert(); rollbackErr != nil {
+		return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+	}
+	return err
+}
+
+// Delete multiple members atomically. If a tombstone was set with SetTombstone, it is
+// written in place of the members
+func (r *RLN) DeleteMembers(indices []MembershipIndex) (err error) {
+	defer recoverFFI("DeleteMembers", &err)
+
+	_, err = r.zeroLeaves(indices)
+	return err
+}
+
+// GetMerkleRoot reads the Merkle Tree root after insertion
+func (r *RLN) GetMerkleRoot() (_ MerkleNode, err error) {
+	defer recoverFFI("GetMerkleRoot", &err)
+
+	b, err := r.w.GetRoot()
+	if err != nil {
+		return MerkleNode{}, err
+	}
+
+	if len(b) != 32 {
+		return MerkleNode{}, errors.New("wrong output size")
+	}
+
+	var result MerkleNode
+	copy(result[:], b)
+
+	return result, nil
+}
+
+// IsCurrentRoot checks whether root is the current root of the Merkle Tree
+func (r *RLN) IsCurrentRoot(root MerkleNode) (bool, error) {
+	currentRoot, err := r.GetMerkleRoot()
+	if err != nil {
+		return false, err
+	}
+
+	return currentRoot == root, nil
+}
+
+// AssertRoot checks that the current root of the Merkle Tree is the expected one,
+// e.g. after restoring a tree. It returns a *ErrRootMismatch if it is not
+func (r *RLN) AssertRoot(expected MerkleNode) error {
+	root, err := r.GetMerkleRoot()
+	if err != nil {
+		return err
+	}
+
+	if root != expected {
+		return &ErrRootMismatch{Got: root, Want: expected}
+	}
+
+	return nil
+}
+
+// GetLeaf reads the value stored at some index in the Merkle Tree
+func (r *RLN) GetLeaf(index MembershipIndex) (_ IDCommitment, err error) {
+	defer recoverFFI("GetLeaf", &err)
+
+	b, err := r.w.GetLeaf(index)
+	if err != nil {
+		return IDCommitment{}, err
+	}
+
+	if len(b) != 32 {
+		return IDCommitment{}, errors.New("wrong output size")
+	}
+
+	var result IDCommitment
+	copy(result[:], b)
+
+	return result, nil
+}
+
+// CheckMembership checks that the leaf stored at `index` is the one of the credential,
+// that is, the poseidon hash of its id commitment and user message limit. It returns
+// false if the member is not at that index, e.g. if it was shifted after deletions
+func (r *RLN) CheckMembership(index MembershipIndex, c IdentityCredential) (bool, error) {
+	expected, err := r.hashLeaf(c.IDCommitment, c.UserMessageLimit)
+	if err != nil {
+		return false, err
+	}
+
+	leaf, err := r.GetLeaf(index)
+	if err != nil {
+		return false, err
+	}
+
+	return leaf == expected, nil
+}
+
+// GetLeavesByIndex reads the values stored at the specified indices in the Merkle Tree,
+// in the same order. It fails if any of the indices is out of the bounds of the tree
+func (r *RLN) GetLeavesByIndex(indices []MembershipIndex) ([]IDCommitment, error) {
+	result := make([]IDCommitment, len(indices))
+	for i, index := range indices {
+		leaf, err := r.GetLeaf(index)
+		if err != nil {
+			return nil, fmt.Errorf("could not get leaf %d: %w", index, err)
+		}
+		result[i] = leaf
+	}
+	return result, nil
+}
+
+// LeafHashes returns the values stored in the Merkle tree for every index up to
+// LeavesSet, in order, including zero leaves for empty and deleted positions. For
+// members inserted with InsertMember, the value is the poseidon hash of the id
+// commitment and the user message limit, not the id commitment
+func (r *RLN) LeafHashes() ([]MerkleNode, error) {
+	numLeaves, err := r.LeavesSetChecked()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetLeavesByIndex(leafRange(0, int(numLeaves)))
+}
+
+// SnapshotReadOnly creates a new instance whose tree holds a copy of the current leaves
+// of this one, so proofs can be generated with it while this instance keeps being
+// modified. The copy is never updated: the proofs it generates carry the root at the
+// time of the snapshot, which verifiers must still accept, e.g. through a window of
+// recent roots. The circuit artifacts embedded in zerokit for the depth of the tree are
+// used, and the snapshot must not be modified
+func (r *RLN) SnapshotReadOnly() (*RLN, error) {
+	leaves, err := r.LeafHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := r.GetMerkleRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := NewWithConfig(r.depth, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.identifier = r.identifier
+	snapshot.signalHasher = r.signalHasher
+
+	if len(leaves) != 0 {
+		if err := snapshot.AtomicOperation(0, leaves, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := snapshot.AssertRoot(root); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
 }
 
-func (r *RLN) InsertRawLeaf(rawLeaf MerkleNode) error {
-	insertionSuccess := r.w.SetNextLeaf(rawLeaf[:])
-	if !insertionSuccess {
-		return errors.New("could not insert raw leaf")
-	}
-	return nil
+// TreeInfo contains statistics about the usage of the Merkle tree
+type TreeInfo struct {
+	// LeavesSet is the index of the highest leaf set plus one
+	LeavesSet uint
+	// Capacity is the amount of leaves the tree can hold
+	Capacity uint64
+	// FillRatio is LeavesSet divided by Capacity
+	FillRatio float64
+	// ZeroLeaves is the amount of empty or deleted leaves below LeavesSet. It is
+	// only computed when requested, as it requires reading every leaf
+	ZeroLeaves uint
 }
 
-// Insert multiple members i.e., identity commitments starting from index
-// This proc is atomic, i.e., if any of the insertions fails, all the previous insertions are rolled back
-func (r *RLN) InsertMembers(index MembershipIndex, idComms []IDCommitment) error {
-	idCommBytes := serializeCommitments(idComms)
-	indicesBytes := serializeIndices(nil)
-	insertionSuccess := r.w.AtomicOperation(index, idCommBytes, indicesBytes)
-	if !insertionSuccess {
-		return errors.New("could not insert members")
+// TreeInfo returns statistics about the usage of the Merkle tree, useful to decide
+// when to use a deeper tree or whether to reuse the positions of deleted members.
+// ZeroLeaves is only counted if `countZeroLeaves` is true: every leaf is then read with
+// its own call into zerokit, which makes the call O(LeavesSet) and not meant for hot paths
+func (r *RLN) TreeInfo(countZeroLeaves bool) (TreeInfo, error) {
+	numLeaves, err := r.LeavesSetChecked()
+	if err != nil {
+		return TreeInfo{}, err
 	}
-	return nil
-}
 
-// Insert a member in the tree at specified index
-func (r *RLN) InsertMemberAt(index MembershipIndex, idComm IDCommitment) error {
-	insertionSuccess := r.w.SetLeaf(index, idComm[:])
-	if !insertionSuccess {
-		return errors.New("could not insert member")
+	info := TreeInfo{
+		LeavesSet: numLeaves,
+		Capacity:  uint64(1) << uint(r.depth),
 	}
-	return nil
+	info.FillRatio = float64(info.LeavesSet) / float64(info.Capacity)
+
+	if countZeroLeaves {
+		for i := MembershipIndex(0); i < numLeaves; i++ {
+			leaf, err := r.GetLeaf(i)
+			if err != nil {
+				return TreeInfo{}, fmt.Errorf("could not get leaf %d: %w", i, err)
+			}
+			if leaf == (MerkleNode{}) {
+				info.ZeroLeaves++
+			}
+		}
+	}
+
+	return info, nil
 }
 
-// DeleteMember removes an IDCommitment key from the tree. The index
-// parameter is the position of the id commitment key to be deleted from the tree.
-// The deleted id commitment key is replaced with a zero leaf
-func (r *RLN) DeleteMember(index MembershipIndex) error {
-	deletionSuccess := r.w.DeleteLeaf(index)
-	if !deletionSuccess {
-		return errors.New("could not delete member")
+// SubtreeRoot calculates the root of the subtree containing the `count` leaves that
+// start at `start`. `count` must be a power of two and `start` a multiple of it, so the
+// leaves form a complete subtree of the Merkle tree
+func (r *RLN) SubtreeRoot(start MembershipIndex, count uint) (MerkleNode, error) {
+	if count == 0 || count&(count-1) != 0 {
+		return MerkleNode{}, fmt.Errorf("subtree size must be a power of two: %d", count)
 	}
-	return nil
-}
 
-// Delete multiple members
-func (r *RLN) DeleteMembers(indices []MembershipIndex) error {
-	idCommBytes := serializeCommitments(nil)
-	indicesBytes := serializeIndices(indices)
-	insertionSuccess := r.w.AtomicOperation(0, idCommBytes, indicesBytes)
-	if !insertionSuccess {
-		return errors.New("could not insert members")
+	if start%count != 0 {
+		return MerkleNode{}, fmt.Errorf("subtree start %d is not aligned to its size %d", start, count)
 	}
-	return nil
-}
 
-// GetMerkleRoot reads the Merkle Tree root after insertion
-func (r *RLN) GetMerkleRoot() (MerkleNode, error) {
-	b, err := r.w.GetRoot()
+	nodes, err := r.GetLeavesByIndex(leafRange(start, int(count)))
 	if err != nil {
 		return MerkleNode{}, err
 	}
 
-	if len(b) != 32 {
-		return MerkleNode{}, errors.New("wrong output size")
+	for len(nodes) > 1 {
+		parents := make([]MerkleNode, len(nodes)/2)
+		for i := range parents {
+			parents[i], err = r.Poseidon(nodes[2*i][:], nodes[2*i+1][:])
+			if err != nil {
+				return MerkleNode{}, err
+			}
+		}
+		nodes = parents
 	}
 
-	var result MerkleNode
-	copy(result[:], b)
-
-	return result, nil
+	return nodes[0], nil
 }
 
-// GetLeaf reads the value stored at some index in the Merkle Tree
-func (r *RLN) GetLeaf(index MembershipIndex) (IDCommitment, error) {
-	b, err := r.w.GetLeaf(index)
-	if err != nil {
-		return IDCommitment{}, err
-	}
-
-	if len(b) != 32 {
-		return IDCommitment{}, errors.New("wrong output size")
-	}
+// IterateLeaves calls fn for each non empty leaf of the Merkle tree, in order. Deleted
+// members are skipped, as their leaf is replaced with a zero leaf. The iteration
+// stops early if fn returns false
+func (r *RLN) IterateLeaves(fn func(index MembershipIndex, leaf IDCommitment) bool) error {
+	numLeaves := r.LeavesSet()
+	for i := MembershipIndex(0); i < numLeaves; i++ {
+		leaf, err := r.GetLeaf(i)
+		if err != nil {
+			return err
+		}
 
-	var result IDCommitment
-	copy(result[:], b)
+		if leaf == (IDCommitment{}) {
+			continue
+		}
 
-	return result, nil
+		if !fn(i, leaf) {
+			return nil
+		}
+	}
+	return nil
 }
 
 // GetMerkleProof returns the Merkle proof for the element at the specified index
@@ -518,7 +1792,9 @@ func (r *RLN) GetLeaf(index MembershipIndex) (IDCommitment, error) {
 // Both num_elements and num_indexes shall be equal and match the tree depth.
 // A tree with depth 20 has 676 bytes = 8 + 32 * 20 + 8 + 20 * 1
 // Proof elements are stored as little endian
-func (r *RLN) GetMerkleProof(index MembershipIndex) (MerkleProof, error) {
+func (r *RLN) GetMerkleProof(index MembershipIndex) (_ MerkleProof, err error) {
+	defer recoverFFI("GetMerkleProof", &err)
+
 	proofBytes, err := r.w.GetMerkleProof(index)
 	if err != nil {
 		return MerkleProof{}, err
@@ -533,6 +1809,201 @@ func (r *RLN) GetMerkleProof(index MembershipIndex) (MerkleProof, error) {
 	return result, nil
 }
 
+// UpdatedPathAfterInsert returns the indices below LeavesSet whose Merkle proofs changed
+// after the leaf at `changedIndex` was modified. The proof of any other leaf contains, at
+// the level where both paths meet, the root of the subtree holding the changed leaf, so
+// all of them are stale except the one of the changed leaf itself, whose path elements
+// don't depend on its value
+func (r *RLN) UpdatedPathAfterInsert(changedIndex MembershipIndex) ([]MembershipIndex, error) {
+	numLeaves, err := r.LeavesSetChecked()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MembershipIndex, 0, numLeaves)
+	for i := MembershipIndex(0); i < numLeaves; i++ {
+		if i != changedIndex {
+			result = append(result, i)
+		}
+	}
+	return result, nil
+}
+
+// GetMerkleProofForOccupied is similar to GetMerkleProof, but returns ErrEmptyLeaf if
+// the leaf at `index` is empty or was deleted, instead of the proof of an empty leaf
+func (r *RLN) GetMerkleProofForOccupied(index MembershipIndex) (MerkleProof, error) {
+	leaf, err := r.GetLeaf(index)
+	if err != nil {
+		return MerkleProof{}, err
+	}
+
+	if leaf == (IDCommitment{}) {
+		return MerkleProof{}, fmt.Errorf("%w: %d", ErrEmptyLeaf, index)
+	}
+
+	return r.GetMerkleProof(index)
+}
+
+// GetMerkleProofs returns the Merkle proofs for the elements at the specified indices,
+// in the same order. The root is read before and after obtaining the proofs, and an
+// error is returned if the tree was modified meanwhile, so all the proofs are
+// guaranteed to belong to the same tree state
+func (r *RLN) GetMerkleProofs(indices []MembershipIndex) ([]MerkleProof, error) {
+	rootBefore, err := r.GetMerkleRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MerkleProof, len(indices))
+	for i, index := range indices {
+		result[i], err = r.GetMerkleProof(index)
+		if err != nil {
+			return nil, fmt.Errorf("could not obtain merkle proof for index %d: %w", index, err)
+		}
+	}
+
+	rootAfter, err := r.GetMerkleRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	if rootBefore != rootAfter {
+		return nil, errors.New("merkle tree was modified while obtaining the proofs")
+	}
+
+	return result, nil
+}
+
+// ComputeMerkleProof builds the Merkle proof of the leaf at `index` for a tree of the
+// given depth containing `leaves`, with every other leaf empty. It allows creating a
+// witness for a tree that is stored elsewhere, without inserting its leaves in a RLN
+// instance. `hash` must be the poseidon hash used by the tree, such as RLN.Poseidon
+func ComputeMerkleProof(leaves []MerkleNode, index MembershipIndex, depth TreeDepth, hash func(...[]byte) (MerkleNode, error)) (MerkleProof, error) {
+	capacity := uint64(1) << uint(depth)
+	if uint64(len(leaves)) > capacity {
+		return MerkleProof{}, fmt.Errorf("%w: %d leaves do not fit in a tree of depth %d", ErrTreeFull, len(leaves), depth)
+	}
+
+	if uint64(index) >= capacity {
+		return MerkleProof{}, fmt.Errorf("index %d is out of bounds for a tree of depth %d", index, depth)
+	}
+
+	proof := MerkleProof{
+		PathElements: make([]MerkleNode, depth),
+		PathIndexes:  make([]uint8, depth),
+	}
+
+	// root of an empty subtree of the current level
+	var zeroNode MerkleNode
+
+	nodes := leaves
+	for level := 0; level < int(depth); level++ {
+		sibling := index ^ 1
+		if sibling < MembershipIndex(len(nodes)) {
+			proof.PathElements[level] = nodes[sibling]
+		} else {
+			proof.PathElements[level] = zeroNode
+		}
+		proof.PathIndexes[level] = uint8(index & 1)
+
+		parents := make([]MerkleNode, (len(nodes)+1)/2)
+		for i := range parents {
+			right := zeroNode
+			if 2*i+1 < len(nodes) {
+				right = nodes[2*i+1]
+			}
+
+			parent, err := hash(nodes[2*i][:], right[:])
+			if err != nil {
+				return MerkleProof{}, err
+			}
+			parents[i] = parent
+		}
+
+		var err error
+		zeroNode, err = hash(zeroNode[:], zeroNode[:])
+		if err != nil {
+			return MerkleProof{}, err
+		}
+
+		nodes = parents
+		index >>= 1
+	}
+
+	return proof, nil
+}
+
+// PartialRoot computes the root of a tree of the given depth containing only the leaves
+// in `leaves`, keyed by their index, with every other leaf empty. Only the paths of the
+// given leaves are hashed, with the roots of empty subtrees used for the rest, so light
+// clients can check a root from a sparse set of leaves. `hash` must be the poseidon hash
+// used by the tree, such as RLN.Poseidon
+func PartialRoot(leaves map[MembershipIndex]MerkleNode, depth TreeDepth, hash func(...[]byte) (MerkleNode, error)) (MerkleNode, error) {
+	capacity := uint64(1) << uint(depth)
+	for index := range leaves {
+		if uint64(index) >= capacity {
+			return MerkleNode{}, fmt.Errorf("index %d is out of bounds for a tree of depth %d", index, depth)
+		}
+	}
+
+	// root of an empty subtree of the current level
+	var zeroNode MerkleNode
+
+	nodes := leaves
+	for level := 0; level < int(depth); level++ {
+		parents := make(map[MembershipIndex]MerkleNode, (len(nodes)+1)/2)
+		for index := range nodes {
+			parentIndex := index >> 1
+			if _, ok := parents[parentIndex]; ok {
+				continue
+			}
+
+			left, ok := nodes[parentIndex<<1]
+			if !ok {
+				left = zeroNode
+			}
+
+			right, ok := nodes[parentIndex<<1|1]
+			if !ok {
+				right = zeroNode
+			}
+
+			parent, err := hash(left[:], right[:])
+			if err != nil {
+				return MerkleNode{}, err
+			}
+			parents[parentIndex] = parent
+		}
+
+		var err error
+		zeroNode, err = hash(zeroNode[:], zeroNode[:])
+		if err != nil {
+			return MerkleNode{}, err
+		}
+
+		nodes = parents
+	}
+
+	if root, ok := nodes[0]; ok {
+		return root, nil
+	}
+
+	// no leaves, so the tree is empty
+	return zeroNode, nil
+}
+
+// PathBits returns the position of each node in the path from the leaf at `index` to the
+// root of a tree of the given depth, with 0 for a left child and 1 for a right child,
+// starting from the leaf. It matches the PathIndexes of the proofs of GetMerkleProof
+func PathBits(index MembershipIndex, depth TreeDepth) []uint8 {
+	bits := make([]uint8, depth)
+	for level := range bits {
+		bits[level] = uint8(index & 1)
+		index >>= 1
+	}
+	return bits
+}
+
 // AddAll adds members to the Merkle tree
 func (r *RLN) AddAll(list []IdentityCredential) error {
 	for _, member := range list {
@@ -543,9 +2014,85 @@ func (r *RLN) AddAll(list []IdentityCredential) error {
 	return nil
 }
 
-// CalcMerkleRoot returns the root of the Merkle tree that is computed from the supplied list
+// StaticGroup returns the IdentityCredentials of the static group defined in STATIC_GROUP_KEYS
+func StaticGroup() ([]IdentityCredential, error) {
+	return StaticGroupCredentials()
+}
+
+// StaticGroupCredentials parses the IdentityCredentials of the static group defined in
+// STATIC_GROUP_KEYS, checking that it has STATIC_GROUP_SIZE members. Their id commitments
+// make up a tree whose root is STATIC_GROUP_MERKLE_ROOT, see StaticGroupRoot
+func StaticGroupCredentials() ([]IdentityCredential, error) {
+	group, err := ToIdentityCredentials(STATIC_GROUP_KEYS)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(group) != STATIC_GROUP_SIZE {
+		return nil, fmt.Errorf("static group has %d members, expected %d", len(group), STATIC_GROUP_SIZE)
+	}
+
+	return group, nil
+}
+
+// StaticGroupRoot calculates the root of the Merkle tree built with the id commitments of
+// the static group. The result must be equal to STATIC_GROUP_MERKLE_ROOT
+func StaticGroupRoot() (MerkleNode, error) {
+	group, err := StaticGroup()
+	if err != nil {
+		return MerkleNode{}, err
+	}
+
+	var idCommitments []IDCommitment
+	for _, c := range group {
+		idCommitments = append(idCommitments, c.IDCommitment)
+	}
+
+	return CalcMerkleRoot(idCommitments)
+}
+
+var emptyRoots = struct {
+	sync.Mutex
+	roots map[TreeDepth]MerkleNode
+}{roots: make(map[TreeDepth]MerkleNode)}
+
+// EmptyRoot returns the root of an empty Merkle tree of the specified depth.
+// It is computed only once per depth, by hashing the empty subtrees of each level,
+// so no circuit needs to be loaded
+func EmptyRoot(depth TreeDepth) (MerkleNode, error) {
+	emptyRoots.Lock()
+	defer emptyRoots.Unlock()
+
+	if root, ok := emptyRoots.roots[depth]; ok {
+		return root, nil
+	}
+
+	root, err := PartialRoot(nil, depth, PoseidonHash)
+	if err != nil {
+		return MerkleNode{}, err
+	}
+
+	emptyRoots.roots[depth] = root
+
+	return root, nil
+}
+
+// CalcMerkleRoot returns the root of the Merkle tree that is computed from the supplied list,
+// using a tree of the default depth
 func CalcMerkleRoot(list []IDCommitment) (MerkleNode, error) {
-	rln, err := NewRLN()
+	return CalcMerkleRootWithDepth(list, DefaultTreeDepth)
+}
+
+// CalcMerkleRootWithDepth returns the root of the Merkle tree of the specified depth
+// that is computed from the supplied list. It returns ErrTreeFull if the list does
+// not fit in the tree
+func CalcMerkleRootWithDepth(list []IDCommitment, depth TreeDepth) (MerkleNode, error) {
+	capacity := uint64(1) << uint(depth)
+	if uint64(len(list)) > capacity {
+		return MerkleNode{}, fmt.Errorf("%w: capacity %d, list size %d", ErrTreeFull, capacity, len(list))
+	}
+
+	rln, err := NewWithConfig(depth, nil)
 	if err != nil {
 		return MerkleNode{}, err
 	}
@@ -557,10 +2104,46 @@ func CalcMerkleRoot(list []IDCommitment) (MerkleNode, error) {
 	return rln.GetMerkleRoot()
 }
 
+// BuildTree creates a RLN instance of the given depth and inserts the members one
+// by one, in order. The leaf of each member is made of leaves[i] and limits[i].
+// It returns the instance along with the root of the tree after each insertion,
+// which can be compared against the test vectors of other implementations
+func BuildTree(depth TreeDepth, leaves []IDCommitment, limits []uint32) (*RLN, []MerkleNode, error) {
+	if len(leaves) != len(limits) {
+		return nil, nil, fmt.Errorf("amount of leaves and limits do not match: %d vs %d", len(leaves), len(limits))
+	}
+
+	rln, err := NewWithConfig(depth, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roots := make([]MerkleNode, 0, len(leaves))
+	for i := range leaves {
+		if err := rln.InsertMember(leaves[i], limits[i]); err != nil {
+			return nil, nil, fmt.Errorf("could not insert leaf %d: %w", i, err)
+		}
+
+		root, err := rln.GetMerkleRoot()
+		if err != nil {
+			return nil, nil, err
+		}
+		roots = append(roots, root)
+	}
+
+	return rln, roots, nil
+}
+
 // CreateMembershipList produces a list of membership key pairs and also returns the root of a Merkle tree constructed
 // out of the identity commitment keys of the generated list. The output of this function is used to initialize a static
 // group keys (to test waku-rln-relay in the off-chain mode)
 func CreateMembershipList(n int) ([]IdentityCredential, MerkleNode, error) {
+	return CreateMembershipListWithLimit(n, DEFAULT_USER_MESSAGE_LIMIT)
+}
+
+// CreateMembershipListWithLimit is like CreateMembershipList, but the memberships are
+// generated with the specified user message limit, which is part of their leaves
+func CreateMembershipListWithLimit(n int, limit uint32) ([]IdentityCredential, MerkleNode, error) {
 	// initialize a Merkle tree
 	rln, err := NewRLN()
 	if err != nil {
@@ -570,7 +2153,7 @@ func CreateMembershipList(n int) ([]IdentityCredential, MerkleNode, error) {
 	var output []IdentityCredential
 	for i := 0; i < n; i++ {
 		// generate a keypair
-		keypair, err := rln.MembershipKeyGen()
+		keypair, err := rln.MembershipKeyGen(limit)
 		if err != nil {
 			return nil, MerkleNode{}, err
 		}
@@ -591,8 +2174,21 @@ func CreateMembershipList(n int) ([]IdentityCredential, MerkleNode, error) {
 	return output, root, nil
 }
 
-// SetMetadata stores serialized data
-func (r *RLN) SetMetadata(metadata []byte) error {
+// tombstoneMetadataPrefix marks metadata that starts with the tombstone set with
+// SetTombstone, stored as [ prefix<8> | tombstone<32> | metadata<var> ]
+var tombstoneMetadataPrefix = []byte("\x00RLNTOMB")
+
+// SetMetadata stores serialized data. If a tombstone was set with SetTombstone, it is
+// stored along with the data, and GetMetadata returns only the data
+func (r *RLN) SetMetadata(metadata []byte) (err error) {
+	defer recoverFFI("SetMetadata", &err)
+
+	if r.tombstone != (MerkleNode{}) {
+		stored := append([]byte{}, tombstoneMetadataPrefix...)
+		stored = append(stored, r.tombstone[:]...)
+		metadata = append(stored, metadata...)
+	}
+
 	success := r.w.SetMetadata(metadata)
 	if !success {
 		return errors.New("could not set metadata")
@@ -601,23 +2197,120 @@ func (r *RLN) SetMetadata(metadata []byte) error {
 }
 
 // GetMetadata returns the stored serialized metadata
-func (r *RLN) GetMetadata() ([]byte, error) {
-	return r.w.GetMetadata()
+func (r *RLN) GetMetadata() (_ []byte, err error) {
+	defer recoverFFI("GetMetadata", &err)
+
+	metadata, err := r.w.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	_, metadata = splitTombstone(metadata)
+	return metadata, nil
+}
+
+// splitTombstone separates the tombstone stored by SetMetadata from the metadata. The
+// tombstone is zero if none was stored
+func splitTombstone(stored []byte) (MerkleNode, []byte) {
+	if len(stored) < len(tombstoneMetadataPrefix)+32 || !bytes.HasPrefix(stored, tombstoneMetadataPrefix) {
+		return MerkleNode{}, stored
+	}
+
+	stored = stored[len(tombstoneMetadataPrefix):]
+	return Bytes32(stored[:32]), stored[32:]
+}
+
+// loadTombstone restores the tombstone stored in the metadata of a tree loaded from disk
+func (r *RLN) loadTombstone() (err error) {
+	defer recoverFFI("loadTombstone", &err)
+
+	metadata, err := r.w.GetMetadata()
+	if err != nil {
+		return err
+	}
+
+	r.tombstone, _ = splitTombstone(metadata)
+	return nil
+}
+
+// AtomicOperation can be used to insert and remove elements into the merkle tree.
+// The leaves at indicesToRemove are zeroed like DeleteMembers, as zerokit's
+// atomic_operation zeroes the wrong leaves when removing more than one index, and
+// then idCommsToInsert are set from index. If the insertion fails, the removed leaves
+// are restored
+func (r *RLN) AtomicOperation(index MembershipIndex, idCommsToInsert []IDCommitment, indicesToRemove []MembershipIndex) (err error) {
+	defer recoverFFI("AtomicOperation", &err)
+
+	_, err = r.atomicOperation(index, idCommsToInsert, indicesToRemove)
+	return err
+}
+
+// atomicOperation removes and inserts leaves like AtomicOperation and returns a function
+// that restores the leaves the operation replaced
+func (r *RLN) atomicOperation(index MembershipIndex, inserts []IDCommitment, removes []MembershipIndex) (func() error, error) {
+	removed, err := r.zeroLeaves(removes)
+	if err != nil {
+		return nil, err
+	}
+
+	revertRemoves := func() error {
+		return r.restoreLeaves(removes, removed)
+	}
+
+	replaced, err := r.GetLeavesByIndex(leafRange(index, len(inserts)))
+	if err != nil {
+		return nil, withRollback(err, revertRemoves)
+	}
+
+	idCommBytes := serializeCommitments(inserts)
+	indicesBytes := serializeIndices(nil)
+	if !r.w.AtomicOperation(index, idCommBytes, indicesBytes) {
+		return nil, withRollback(errors.New("could not execute atomic_operation"), revertRemoves)
+	}
+
+	revert := func() error {
+		if len(replaced) != 0 && !r.w.AtomicOperation(index, serializeCommitments(replaced), indicesBytes) {
+			return errors.New("could not restore the inserted leaves")
+		}
+		return revertRemoves()
+	}
+
+	return revert, nil
 }
 
-// AtomicOperation can be used to insert and remove elements into the merkle tree
-func (r *RLN) AtomicOperation(index MembershipIndex, idCommsToInsert []IDCommitment, indicesToRemove []MembershipIndex) error {
-	idCommBytes := serializeCommitments(idCommsToInsert)
-	indicesBytes := serializeIndices(indicesToRemove)
-	execSuccess := r.w.AtomicOperation(index, idCommBytes, indicesBytes)
-	if !execSuccess {
-		return errors.New("could not execute atomic_operation")
+// AtomicOperationWithMetadata removes and inserts leaves like AtomicOperation and then
+// stores the metadata, so a sync cursor kept in the metadata never gets ahead of the
+// tree. zerokit can't update the tree and the metadata in a single write, so if storing
+// the metadata fails, the leaves replaced by the operation are restored. LeavesSet is
+// not restored
+func (r *RLN) AtomicOperationWithMetadata(index MembershipIndex, inserts []IDCommitment, removes []MembershipIndex, metadata []byte) (err error) {
+	defer recoverFFI("AtomicOperationWithMetadata", &err)
+
+	revert, err := r.atomicOperation(index, inserts, removes)
+	if err != nil {
+		return err
+	}
+
+	if err := r.SetMetadata(metadata); err != nil {
+		return withRollback(err, revert)
 	}
+
 	return nil
 }
 
+// leafRange returns the indices of n consecutive leaves starting at index
+func leafRange(index MembershipIndex, n int) []MembershipIndex {
+	result := make([]MembershipIndex, n)
+	for i := range result {
+		result[i] = index + MembershipIndex(i)
+	}
+	return result
+}
+
 // Flush
-func (r *RLN) Flush() error {
+func (r *RLN) Flush() (err error) {
+	defer recoverFFI("Flush", &err)
+
 	success := r.w.Flush()
 	if !success {
 		return errors.New("cannot flush db")
@@ -625,7 +2318,59 @@ func (r *RLN) Flush() error {
 	return nil
 }
 
-// LeavesSet indicates how many elements have been inserted in the merkle tree
+// FlushWithRetry flushes the db like Flush, retrying up to `attempts` times in total
+// if it fails. The wait between attempts starts at `backoff` and doubles after each
+// failure. The error of the last attempt is returned if all of them fail
+func (r *RLN) FlushWithRetry(attempts int, backoff time.Duration) error {
+	if attempts < 1 {
+		return fmt.Errorf("invalid number of attempts: %d", attempts)
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = r.Flush()
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("flush failed after %d attempts: %w", attempts, err)
+}
+
+// LeavesSet indicates how many elements have been inserted in the merkle tree. It is
+// the index of the highest leaf set plus one, not the count of non-zero leaves: gaps left
+// by InsertMemberAt and leaves zeroed by DeleteMember are included
 func (r *RLN) LeavesSet() uint {
 	return r.w.LeavesSet()
 }
+
+// HighWaterMark returns the highest index that was ever set in the merkle tree plus one,
+// which is the index where InsertMember places the next member. Inserting at a higher
+// index with InsertMemberAt raises it, leaving the indices in between empty, and deleting
+// members never lowers it
+func (r *RLN) HighWaterMark() MembershipIndex {
+	return MembershipIndex(r.w.LeavesSet())
+}
+
+// LeavesSetChecked is similar to LeavesSet, but returns an error if the merkle tree
+// could not be accessed instead of silently reporting 0 leaves
+func (r *RLN) LeavesSetChecked() (_ uint, err error) {
+	defer recoverFFI("LeavesSetChecked", &err)
+
+	if r.w == nil {
+		return 0, errors.New("rln instance is not initialized")
+	}
+
+	// leaves_set cannot report failures, so the tree is read first to
+	// ensure it is accessible
+	if _, err := r.w.GetRoot(); err != nil {
+		return 0, fmt.Errorf("could not read merkle tree: %w", err)
+	}
+
+	return r.w.LeavesSet(), nil
+}
@@ -2,11 +2,21 @@ package rln
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"math"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
+	"github.com/waku-org/go-zerokit-rln/rln/link"
 )
 
 func TestRLNSuite(t *testing.T) {
@@ -15,6 +25,57 @@ func TestRLNSuite(t *testing.T) {
 
 type RLNSuite struct {
 	suite.Suite
+
+	// wrappers are reused across tests, as loading the circuit takes seconds.
+	// newRLN hands each of them out at most once per test, with an empty tree
+	wrappers []*link.RLNWrapper
+	used     int
+}
+
+func (s *RLNSuite) SetupTest() {
+	s.used = 0
+}
+
+// newRLN returns an instance with an empty tree of the default depth, like NewRLN,
+// reusing the circuit loaded by a previous test when possible
+func (s *RLNSuite) newRLN() *RLN {
+	return s.newRLNWithDepth(DefaultTreeDepth)
+}
+
+// newRLNWithDepth is like newRLN, with an empty tree of the given depth. The circuit
+// stays the one of the default depth, so it is only meant for tree operations
+func (s *RLNSuite) newRLNWithDepth(depth TreeDepth) *RLN {
+	if s.used == len(s.wrappers) {
+		rln, err := NewRLN()
+		s.Require().NoError(err)
+		s.wrappers = append(s.wrappers, rln.w)
+	}
+
+	w := s.wrappers[s.used]
+	s.used++
+	s.Require().True(w.SetTree(uint(depth)))
+
+	rln := &RLN{w: w, depth: depth}
+	s.Require().NoError(rln.initialize(nil))
+
+	return rln
+}
+
+// newRLNWithProof returns an instance from newRLN with a single member at index 0, along
+// with the member's credentials and a proof of msg for the given epoch and message id
+func (s *RLNSuite) newRLNWithProof(msg []byte, epoch Epoch, messageID uint32) (*RLN, *IdentityCredential, *RateLimitProof) {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.Require().NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.Require().NoError(err)
+
+	proof, err := rln.GenerateProof(msg, *memKeys, MembershipIndex(0), epoch, messageID)
+	s.Require().NoError(err)
+
+	return rln, memKeys, proof
 }
 
 func (s *RLNSuite) TestNew() {
@@ -34,9 +95,79 @@ func (s *RLNSuite) TestNew() {
 	s.Equal(root1, root2)
 }
 
-func (s *RLNSuite) TestMembershipKeyGen() {
-	rln, err := NewRLN()
+func (s *RLNSuite) TestNewWithResourcesPath() {
+	resourcesPath := s.T().TempDir()
+	_, err := NewWithConfig(DefaultTreeDepth, &TreeConfig{ResourcesPath: resourcesPath})
+	s.ErrorIs(err, os.ErrNotExist)
+
+	folder := filepath.Join(resourcesPath, "tree_height_20")
+	s.NoError(os.MkdirAll(folder, 0755))
+	s.NoError(os.WriteFile(filepath.Join(folder, "rln.wasm"), []byte{0x00}, 0644))
+	s.NoError(os.WriteFile(filepath.Join(folder, "rln_final.zkey"), []byte{0x00}, 0644))
+
+	_, err = NewWithConfig(DefaultTreeDepth, &TreeConfig{ResourcesPath: resourcesPath})
+	var notFoundErr *ErrResourcesNotFound
+	s.ErrorAs(err, &notFoundErr)
+	s.Equal(TreeDepth20, notFoundErr.Depth)
+	s.Equal(filepath.Join(folder, "verification_key.json"), notFoundErr.Path)
+}
+
+func (s *RLNSuite) TestNewRLNWithParamsChecked() {
+	_, err := NewRLNWithParamsChecked(20, []byte{0x00}, []byte{0x00}, []byte("{}"), nil)
+	s.ErrorIs(err, ErrIncompatibleArtifacts)
+}
+
+func (s *RLNSuite) TestNewRLNWithOptions() {
+	rln, err := NewRLNWithOptions(DefaultTreeDepth, WithCacheCapacity(1000))
+	s.NoError(err)
+
+	err = rln.InsertMember(IDCommitment{0x01}, 1)
+	s.NoError(err)
+	s.Equal(uint(1), rln.LeavesSet())
+
+	treeConfig := &TreeConfig{}
+	WithCacheCapacity(1000)(treeConfig)
+	s.Equal(1000, treeConfig.CacheCapacity)
+
+	// an empty path is still sent to zerokit
+	b, err := json.Marshal(treeConfig)
+	s.NoError(err)
+	s.Contains(string(b), `"path":""`)
+	s.NotContains(string(b), `"temporary"`)
+
+	// while the instances created without a path use a temporary db, rather than
+	// creating it in the working directory
+	_, err = os.Stat("conf")
+	s.True(os.IsNotExist(err))
+
+	treeConfig.temporary = true
+	b, err = json.Marshal(treeConfig)
 	s.NoError(err)
+	s.Contains(string(b), `"path":null`)
+	s.Contains(string(b), `"temporary":true`)
+}
+
+func (s *RLNSuite) TestDBPath() {
+	path := filepath.Join(s.T().TempDir(), "db")
+
+	rln, err := NewRLNWithOptions(DefaultTreeDepth, WithDBPath(path))
+	s.NoError(err)
+
+	err = rln.InsertMember(IDCommitment{0x01}, 1)
+	s.NoError(err)
+	s.NoError(rln.Flush())
+	s.DirExists(path)
+
+	// a file is in the way of the directory
+	file := filepath.Join(s.T().TempDir(), "file")
+	s.NoError(os.WriteFile(file, []byte{0x00}, 0644))
+
+	_, err = NewRLNWithOptions(DefaultTreeDepth, WithDBPath(filepath.Join(file, "db")))
+	s.ErrorIs(err, ErrDBPath)
+}
+
+func (s *RLNSuite) TestMembershipKeyGen() {
+	rln := s.newRLN()
 
 	key, err := rln.MembershipKeyGen()
 	s.NoError(err)
@@ -55,8 +186,7 @@ func (s *RLNSuite) TestMembershipKeyGen() {
 }
 
 func (s *RLNSuite) TestGetMerkleRoot() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	root1, err := rln.GetMerkleRoot()
 	s.NoError(err)
@@ -70,8 +200,7 @@ func (s *RLNSuite) TestGetMerkleRoot() {
 }
 
 func (s *RLNSuite) TestInsertMember() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	keypair, err := rln.MembershipKeyGen()
 	s.NoError(err)
@@ -81,8 +210,7 @@ func (s *RLNSuite) TestInsertMember() {
 }
 
 func (s *RLNSuite) TestInsertRawLeaf() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	for i := 0; i < 10; i++ {
 		// Generate a membership
@@ -111,10 +239,37 @@ func (s *RLNSuite) TestInsertRawLeaf() {
 	}
 }
 
-func (s *RLNSuite) TestInsertMembers() {
-	rln, err := NewRLN()
+func (s *RLNSuite) TestInsertLeafHash() {
+	rln1 := s.newRLN()
+
+	rln2 := s.newRLN()
+
+	for i := 0; i < 5; i++ {
+		memKeys, err := rln1.MembershipKeyGen(uint32(i + 1))
+		s.NoError(err)
+
+		err = rln1.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+		s.NoError(err)
+
+		leaf, err := rln1.GetLeaf(MembershipIndex(i))
+		s.NoError(err)
+
+		err = rln2.InsertLeafHash(MembershipIndex(i), leaf)
+		s.NoError(err)
+	}
+
+	root1, err := rln1.GetMerkleRoot()
+	s.NoError(err)
+
+	root2, err := rln2.GetMerkleRoot()
 	s.NoError(err)
 
+	s.Equal(root1, root2)
+}
+
+func (s *RLNSuite) TestInsertMembers() {
+	rln := s.newRLN()
+
 	var commitments []IDCommitment
 	for i := 0; i < 10; i++ {
 		keypair, err := rln.MembershipKeyGen()
@@ -122,16 +277,26 @@ func (s *RLNSuite) TestInsertMembers() {
 		commitments = append(commitments, keypair.IDCommitment)
 	}
 
-	err = rln.InsertMembers(0, commitments)
+	err := rln.InsertMembers(0, commitments)
 	s.NoError(err)
 
 	numLeaves := rln.LeavesSet()
 	s.Equal(uint(10), numLeaves)
+
+	numLeaves, err = rln.LeavesSetChecked()
+	s.NoError(err)
+	s.Equal(uint(10), numLeaves)
+}
+
+func (s *RLNSuite) TestLeavesSetCheckedUninitialized() {
+	rln := &RLN{}
+
+	_, err := rln.LeavesSetChecked()
+	s.Error(err)
 }
 
 func (s *RLNSuite) TestRemoveMember() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	keypair, err := rln.MembershipKeyGen()
 	s.NoError(err)
@@ -143,9 +308,131 @@ func (s *RLNSuite) TestRemoveMember() {
 	s.NoError(err)
 }
 
-func (s *RLNSuite) TestMerkleTreeConsistenceBetweenDeletionAndInsertion() {
-	rln, err := NewRLN()
+func (s *RLNSuite) TestDeleteMemberByCommitment() {
+	rln := s.newRLN()
+
+	root1, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	var keys []*IdentityCredential
+	for i := 0; i < 3; i++ {
+		keypair, err := rln.MembershipKeyGen()
+		s.NoError(err)
+
+		err = rln.InsertMember(keypair.IDCommitment, keypair.UserMessageLimit)
+		s.NoError(err)
+		keys = append(keys, keypair)
+	}
+
+	err = rln.DeleteMemberByCommitment(keys[1].IDCommitment, keys[1].UserMessageLimit)
+	s.NoError(err)
+
+	leaf, err := rln.GetLeaf(1)
+	s.NoError(err)
+	s.Equal(IDCommitment{}, leaf)
+
+	// already deleted
+	err = rln.DeleteMemberByCommitment(keys[1].IDCommitment, keys[1].UserMessageLimit)
+	s.ErrorIs(err, ErrMemberNotFound)
+
+	// wrong user message limit
+	err = rln.DeleteMemberByCommitment(keys[0].IDCommitment, keys[0].UserMessageLimit+1)
+	s.ErrorIs(err, ErrMemberNotFound)
+
+	err = rln.DeleteMemberByCommitment(keys[0].IDCommitment, keys[0].UserMessageLimit)
+	s.NoError(err)
+	err = rln.DeleteMemberByCommitment(keys[2].IDCommitment, keys[2].UserMessageLimit)
+	s.NoError(err)
+
+	root2, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(root1, root2)
+}
+
+func (s *RLNSuite) TestDeleteMembersByCommitment() {
+	rln := s.newRLN()
+
+	var members []IDCommitmentWithLimit
+	for i := 0; i < 5; i++ {
+		keypair, err := rln.MembershipKeyGen(uint32(i + 1))
+		s.NoError(err)
+
+		err = rln.InsertMember(keypair.IDCommitment, keypair.UserMessageLimit)
+		s.NoError(err)
+		members = append(members, IDCommitmentWithLimit{keypair.IDCommitment, keypair.UserMessageLimit})
+	}
+
+	root1, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	// one of the members does not exist, so nothing is deleted
+	err = rln.DeleteMembersByCommitment([]IDCommitmentWithLimit{members[3], {IDCommitment: [32]byte{0x01}, UserMessageLimit: 1}})
+	s.ErrorIs(err, ErrMemberNotFound)
+
+	root2, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(root1, root2)
+
+	err = rln.DeleteMembersByCommitment([]IDCommitmentWithLimit{members[3], members[1]})
+	s.NoError(err)
+
+	for i := range members {
+		leaf, err := rln.GetLeaf(MembershipIndex(i))
+		s.NoError(err)
+		if i == 1 || i == 3 {
+			s.Equal(IDCommitment{}, leaf)
+		} else {
+			s.NotEqual(IDCommitment{}, leaf)
+		}
+	}
+}
+
+func (s *RLNSuite) TestDeleteMembers() {
+	rln := s.newRLN()
+
+	var leaves []IDCommitment
+	for i := 0; i < 10; i++ {
+		leaves = append(leaves, IDCommitment{byte(i + 1)})
+	}
+
+	err := rln.InsertMembers(0, leaves)
+	s.NoError(err)
+
+	// only the non adjacent indices are removed
+	err = rln.DeleteMembers([]MembershipIndex{2, 7})
+	s.NoError(err)
+
+	expected := append([]IDCommitment{}, leaves...)
+	expected[2] = IDCommitment{}
+	expected[7] = IDCommitment{}
+
+	current, err := rln.LeafHashes()
+	s.NoError(err)
+	s.Equal(expected, current)
+
+	// same for the removals of an atomic operation
+	err = rln.AtomicOperation(10, []IDCommitment{{0x0b}}, []MembershipIndex{1, 4})
+	s.NoError(err)
+
+	expected[1] = IDCommitment{}
+	expected[4] = IDCommitment{}
+	expected = append(expected, IDCommitment{0x0b})
+
+	current, err = rln.LeafHashes()
 	s.NoError(err)
+	s.Equal(expected, current)
+
+	// the removals are reverted if the insertion fails
+	err = rln.AtomicOperation(1<<20, []IDCommitment{{0x0c}}, []MembershipIndex{0, 9})
+	s.Error(err)
+
+	current, err = rln.LeafHashes()
+	s.NoError(err)
+	s.Equal(expected, current)
+}
+
+func (s *RLNSuite) TestMerkleTreeConsistenceBetweenDeletionAndInsertion() {
+	rln := s.newRLN()
 
 	root1, err := rln.GetMerkleRoot()
 	s.NoError(err)
@@ -180,10 +467,35 @@ func (s *RLNSuite) TestMerkleTreeConsistenceBetweenDeletionAndInsertion() {
 	s.Equal(root1, root3)
 }
 
-func (s *RLNSuite) TestHash() {
-	rln, err := NewRLN()
+func (s *RLNSuite) TestEmptyRoot() {
+	for _, treeDepth := range []TreeDepth{TreeDepth15, TreeDepth20} {
+		rln := s.newRLNWithDepth(treeDepth)
+
+		expectedRoot, err := rln.GetMerkleRoot()
+		s.NoError(err)
+
+		root, err := EmptyRoot(treeDepth)
+		s.NoError(err)
+		s.Equal(expectedRoot, root)
+
+		// cached value
+		root, err = EmptyRoot(treeDepth)
+		s.NoError(err)
+		s.Equal(expectedRoot, root)
+	}
+
+	root15, err := EmptyRoot(TreeDepth15)
 	s.NoError(err)
 
+	root20, err := EmptyRoot(TreeDepth20)
+	s.NoError(err)
+
+	s.NotEqual(root15, root20)
+}
+
+func (s *RLNSuite) TestHash() {
+	rln := s.newRLN()
+
 	// prepare the input
 	msg := []byte("Hello")
 	hash, err := rln.Sha256(msg)
@@ -194,8 +506,7 @@ func (s *RLNSuite) TestHash() {
 }
 
 func (s *RLNSuite) TestPoseidon() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	// prepare the input
 	msg1, _ := hex.DecodeString("126f4c026cd731979365f79bd345a46d673c5a3f6f588bdc718e6356d02b6fdc")
@@ -215,6 +526,26 @@ func (s *RLNSuite) TestCreateListMembershipKeysAndCreateMerkleTreeFromList() {
 	s.Len(root, HASH_HEX_SIZE) // check the size of the calculated tree root
 }
 
+func (s *RLNSuite) TestCreateMembershipListWithLimit() {
+	groupSize := 5
+	list, root, err := CreateMembershipListWithLimit(groupSize, 42)
+	s.NoError(err)
+	s.Len(list, groupSize)
+
+	rln := s.newRLN()
+
+	// the root reflects the limit of each member
+	for _, c := range list {
+		s.Equal(uint32(42), c.UserMessageLimit)
+		err = rln.InsertMember(c.IDCommitment, 42)
+		s.NoError(err)
+	}
+
+	expectedRoot, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(expectedRoot, root)
+}
+
 func (s *RLNSuite) TestCheckCorrectness() {
 	groupKeys := STATIC_GROUP_KEYS
 
@@ -238,9 +569,33 @@ func (s *RLNSuite) TestCheckCorrectness() {
 	s.Equal(expectedRoot, root[:])
 }
 
-func (s *RLNSuite) TestGetLeaf() {
-	rln, err := NewRLN()
+func (s *RLNSuite) TestStaticGroup() {
+	group, err := StaticGroup()
 	s.NoError(err)
+	s.Len(group, STATIC_GROUP_SIZE)
+
+	root, err := StaticGroupRoot()
+	s.NoError(err)
+
+	expectedRoot, _ := hex.DecodeString(STATIC_GROUP_MERKLE_ROOT)
+	s.Equal(expectedRoot, root[:])
+}
+
+func (s *RLNSuite) TestStaticGroupCredentials() {
+	rln := s.newRLN()
+
+	group, err := StaticGroupCredentials()
+	s.NoError(err)
+	s.Len(group, STATIC_GROUP_SIZE)
+	s.Equal(FromIdentityCredentials(group), STATIC_GROUP_KEYS)
+
+	valid, err := rln.ValidateCredential(group[0])
+	s.NoError(err)
+	s.True(valid)
+}
+
+func (s *RLNSuite) TestGetLeaf() {
+	rln := s.newRLN()
 
 	amountLeafs := int(31)
 
@@ -272,8 +627,7 @@ func (s *RLNSuite) TestGetLeaf() {
 }
 
 func (s *RLNSuite) TestValidProof() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	// allowed messages per epoch of the membership
 	userMessageLimit := uint32(10)
@@ -329,9 +683,74 @@ func (s *RLNSuite) TestValidProof() {
 	}
 }
 
-func (s *RLNSuite) TestProofBeyondLimit() {
-	rln, err := NewRLN()
+func (s *RLNSuite) TestVerifier() {
+	msg := []byte("Hello")
+	rln, _, proof := s.newRLNWithProof(msg, ToEpoch(1000), 0)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	verifier, err := rln.NewVerifier([][32]byte{{0x01}, root, root})
+	s.NoError(err)
+
+	verified, err := verifier.Verify(msg, *proof)
+	s.NoError(err)
+	s.True(verified)
+
+	verified, err = verifier.Verify([]byte("different message"), *proof)
+	s.NoError(err)
+	s.False(verified)
+
+	// root is not part of the valid roots
+	verifier, err = rln.NewVerifier([][32]byte{{0x01}})
+	s.NoError(err)
+
+	verified, err = verifier.Verify(msg, *proof)
+	s.NoError(err)
+	s.False(verified)
+
+	// the roots are checked like in Verify
+	var invalidRoot [32]byte
+	for i := range invalidRoot {
+		invalidRoot[i] = 0xff
+	}
+	_, err = rln.NewVerifier([][32]byte{root, invalidRoot})
+	s.ErrorIs(err, ErrInvalidRoot)
+}
+
+func (s *RLNSuite) TestBatchVerifyPerItemRoots() {
+	rln := s.newRLN()
+
+	msg := []byte("Hello")
+	var items []VerifyItemWithRoots
+	var roots [][32]byte
+	for i := 0; i < 3; i++ {
+		memKeys, err := rln.MembershipKeyGen()
+		s.NoError(err)
+
+		err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+		s.NoError(err)
+
+		root, err := rln.GetMerkleRoot()
+		s.NoError(err)
+		roots = append(roots, root)
+
+		proof, err := rln.GenerateProof(msg, *memKeys, MembershipIndex(i), ToEpoch(1000), 0)
+		s.NoError(err)
+
+		items = append(items, VerifyItemWithRoots{Data: msg, Proof: *proof, Roots: [][32]byte{root}})
+	}
+
+	// the last proof is checked against a root it was not generated with
+	items[2].Roots = [][32]byte{roots[0], roots[1]}
+
+	result, err := rln.BatchVerifyPerItemRoots(items)
 	s.NoError(err)
+	s.Equal([]bool{true, true, false}, result)
+}
+
+func (s *RLNSuite) TestProofBeyondLimit() {
+	rln := s.newRLN()
 
 	// allowed messages per epoch of the membership
 	userMessageLimit := uint32(10)
@@ -375,8 +794,7 @@ func (s *RLNSuite) TestProofBeyondLimit() {
 }
 
 func (s *RLNSuite) TestInvalidProof() {
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	memKeys, err := rln.MembershipKeyGen()
 	s.NoError(err)
@@ -424,12 +842,35 @@ func (s *RLNSuite) TestInvalidProof() {
 	s.False(verified)
 }
 
-func (s *RLNSuite) TestGetMerkleProof() {
+func (s *RLNSuite) TestMerkleProofBytes() {
 	for _, treeDepth := range []TreeDepth{TreeDepth15, TreeDepth19, TreeDepth20} {
 		treeDepthInt := int(treeDepth)
 
-		rln, err := NewWithConfig(treeDepth, nil)
+		rln := s.newRLNWithDepth(treeDepth)
+
+		err := rln.InsertMemberAt(3, [32]byte{0x03})
+		s.NoError(err)
+
+		proof, err := rln.GetMerkleProof(3)
+		s.NoError(err)
+
+		b := proof.Bytes()
+		s.Equal(8+32*treeDepthInt+8+treeDepthInt, len(b))
+
+		parsed, err := ParseMerkleProof(b)
 		s.NoError(err)
+		s.Equal(proof, *parsed)
+
+		_, err = ParseMerkleProof(b[:len(b)-1])
+		s.Error(err)
+	}
+}
+
+func (s *RLNSuite) TestGetMerkleProof() {
+	for _, treeDepth := range []TreeDepth{TreeDepth15, TreeDepth19, TreeDepth20} {
+		treeDepthInt := int(treeDepth)
+
+		rln := s.newRLNWithDepth(treeDepth)
 
 		leaf0 := [32]byte{0x00}
 		leaf1 := [32]byte{0x01}
@@ -462,13 +903,62 @@ func (s *RLNSuite) TestGetMerkleProof() {
 	}
 }
 
-func (s *RLNSuite) TestGenerateRLNProofWithWitness_VerifiesOK() {
-	treeSize := 20
-	userMessageLimit := uint32(100)
-	message := []byte("some rln protected message")
+func (s *RLNSuite) TestIterateLeaves() {
+	rln := s.newRLN()
 
-	rln, err := NewRLN()
-	s.NoError(err)
+	for i := 0; i < 6; i++ {
+		err := rln.InsertMemberAt(MembershipIndex(i), [32]byte{byte(i + 1)})
+		s.NoError(err)
+	}
+
+	err := rln.DeleteMember(2)
+	s.NoError(err)
+
+	var indices []MembershipIndex
+	err = rln.IterateLeaves(func(index MembershipIndex, leaf IDCommitment) bool {
+		s.Equal(IDCommitment{byte(index + 1)}, leaf)
+		indices = append(indices, index)
+		return true
+	})
+	s.NoError(err)
+	s.Equal([]MembershipIndex{0, 1, 3, 4, 5}, indices)
+
+	// stop early
+	indices = nil
+	err = rln.IterateLeaves(func(index MembershipIndex, leaf IDCommitment) bool {
+		indices = append(indices, index)
+		return index < 3
+	})
+	s.NoError(err)
+	s.Equal([]MembershipIndex{0, 1, 3}, indices)
+}
+
+func (s *RLNSuite) TestGetMerkleProofs() {
+	rln := s.newRLN()
+
+	for i := 0; i < 8; i++ {
+		err := rln.InsertMemberAt(MembershipIndex(i), [32]byte{byte(i + 1)})
+		s.NoError(err)
+	}
+
+	indices := []MembershipIndex{6, 0, 3, 12}
+	proofs, err := rln.GetMerkleProofs(indices)
+	s.NoError(err)
+	s.Len(proofs, len(indices))
+
+	for i, index := range indices {
+		expected, err := rln.GetMerkleProof(index)
+		s.NoError(err)
+		s.Equal(expected, proofs[i])
+	}
+}
+
+func (s *RLNSuite) TestGenerateRLNProofWithWitness_VerifiesOK() {
+	treeSize := 20
+	userMessageLimit := uint32(100)
+	message := []byte("some rln protected message")
+
+	rln := s.newRLN()
 
 	treeElements := make([]IdentityCredential, 0)
 
@@ -522,22 +1012,61 @@ func (s *RLNSuite) TestGenerateRLNProofWithWitness_VerifiesOK() {
 
 				// Proof generate with custom witness match the proof generate with the witness
 				// from zerokit. Proof itself is not asserted, can be different.
-				s.Equal(proofRes1.MerkleRoot, proofRes2.MerkleRoot)
-				s.Equal(proofRes1.ExternalNullifier, proofRes2.ExternalNullifier)
-				s.Equal(proofRes1.ShareX, proofRes2.ShareX)
-				s.Equal(proofRes1.ShareY, proofRes2.ShareY)
-				s.Equal(proofRes1.Nullifier, proofRes2.Nullifier)
+				s.True(ProofsAgree(*proofRes1, *proofRes2))
 			}
 		}
 	}
 }
 
+func (s *RLNSuite) TestGenerateRLNProofWithWitness_EmptyTree() {
+	message := []byte("some rln protected message")
+
+	// the tree is held by a different instance
+	treeRLN := s.newRLN()
+
+	var memberKeys *IdentityCredential
+	var err error
+	for i := 0; i < 5; i++ {
+		memberKeys, err = treeRLN.MembershipKeyGen()
+		s.NoError(err)
+
+		err = treeRLN.InsertMember(memberKeys.IDCommitment, memberKeys.UserMessageLimit)
+		s.NoError(err)
+	}
+
+	root, err := treeRLN.GetMerkleRoot()
+	s.NoError(err)
+
+	merkleProof, err := treeRLN.GetMerkleProof(4)
+	s.NoError(err)
+
+	// the prover has no members in its tree
+	prover := s.newRLN()
+	s.Equal(uint(0), prover.LeavesSet())
+
+	witness, err := prover.CreateWitness(memberKeys.IDSecretHash, memberKeys.UserMessageLimit, 1, message, ToEpoch(1000), merkleProof)
+	s.NoError(err)
+
+	proof, err := prover.GenerateRLNProofWithWitness(witness)
+	s.NoError(err)
+	s.Equal(root, proof.MerkleRoot)
+
+	verified, err := treeRLN.Verify(message, *proof, root)
+	s.NoError(err)
+	s.True(verified)
+
+	verified, err = prover.Verify(message, *proof, root)
+	s.NoError(err)
+	s.True(verified)
+
+	s.Equal(uint(0), prover.LeavesSet())
+}
+
 func (s *RLNSuite) TestGenerateRLNProofWithWitness_VerifiesNOK() {
 
 	treeSize := 20
 
-	rln, err := NewRLN()
-	s.NoError(err)
+	rln := s.newRLN()
 
 	treeElements := make([]IdentityCredential, 0)
 
@@ -657,6 +1186,13 @@ func (s *RLNSuite) TestEpochConsistency() {
 	decodedEpoch := epochBytes.Uint64()
 
 	s.Equal(epoch, decodedEpoch)
+
+	epochBytesBE := ToEpochBE(epoch)
+	s.Equal(epoch, epochBytesBE.Uint64BE())
+
+	s.Equal(ToEpoch(1).Uint64(), ToEpochBE(1).Uint64BE())
+	s.Equal(byte(1), ToEpoch(1)[0])
+	s.Equal(byte(1), ToEpochBE(1)[31])
 }
 
 func (s *RLNSuite) TestEpochComparison() {
@@ -670,3 +1206,1810 @@ func (s *RLNSuite) TestEpochComparison() {
 	s.Equal(int64(1), Diff(epoch1, epoch2))
 	s.Equal(int64(-1), Diff(epoch2, epoch1))
 }
+
+func (s *RLNSuite) TestNextEpochBoundary() {
+	now := time.Unix(1000, 500)
+	boundary := NextEpochBoundary(now, 10*time.Second)
+	s.Equal(time.Unix(1010, 0), boundary)
+	s.Equal(int64(1), Diff(CalcEpoch(boundary, 10), CalcEpoch(now, 10)))
+
+	// an instant right at the boundary belongs to the new epoch
+	s.Equal(time.Unix(1020, 0), NextEpochBoundary(boundary, 10*time.Second))
+
+	s.Equal(time.Unix(1000, int64(250*time.Millisecond)), NextEpochBoundary(time.Unix(1000, 1), 250*time.Millisecond))
+
+	// instants before the unix epoch
+	s.Equal(time.Unix(-10, 0), NextEpochBoundary(time.Unix(-15, 0), 10*time.Second))
+
+	// no epochs without a positive resolution
+	s.Equal(now, NextEpochBoundary(now, 0))
+	s.Equal(now, NextEpochBoundary(now, -time.Second))
+}
+
+func (s *RLNSuite) TestEpochFormat() {
+	epoch := CalcEpoch(time.Date(2023, 5, 4, 10, 20, 35, 0, time.UTC), 10)
+	s.Equal("2023-05-04T10:20:30Z", epoch.Format(10*time.Second, time.RFC3339))
+	s.Equal(epoch, CalcEpoch(epoch.Time(10), 10))
+}
+
+func (s *RLNSuite) TestParseTreeDepth() {
+	for input, expected := range map[string]TreeDepth{
+		"15":          TreeDepth15,
+		"19":          TreeDepth19,
+		" 20 ":        TreeDepth20,
+		"TreeDepth20": TreeDepth20,
+		"treedepth19": TreeDepth19,
+	} {
+		depth, err := ParseTreeDepth(input)
+		s.NoError(err)
+		s.Equal(expected, depth)
+	}
+
+	for _, input := range []string{"", "16", "32", "TreeDepth", "TreeDepth21", "twenty"} {
+		_, err := ParseTreeDepth(input)
+		s.ErrorIs(err, ErrUnsupportedDepth)
+	}
+}
+
+func (s *RLNSuite) TestRecoverFromFFIPanic() {
+	// an uninitialized instance panics when calling into zerokit
+	rln := &RLN{}
+
+	_, err := rln.GetMerkleRoot()
+	s.ErrorIs(err, ErrInternal)
+
+	err = rln.InsertMember(IDCommitment{}, 1)
+	s.ErrorIs(err, ErrInternal)
+}
+
+func (s *RLNSuite) TestValidateProof() {
+	msg := []byte("Hello")
+	rln, _, proof := s.newRLNWithProof(msg, ToEpoch(1000), 0)
+	s.NoError(proof.Validate())
+
+	emptyRoot := *proof
+	emptyRoot.MerkleRoot = MerkleNode{}
+	s.ErrorIs(emptyRoot.Validate(), ErrDegenerateProof)
+
+	emptyProof := *proof
+	emptyProof.Proof = ZKSNARK{}
+	s.ErrorIs(emptyProof.Validate(), ErrDegenerateProof)
+
+	emptyNullifier := *proof
+	emptyNullifier.Nullifier = Nullifier{}
+	s.ErrorIs(emptyNullifier.Validate(), ErrDegenerateProof)
+
+	verified, err := rln.Verify(msg, RateLimitProof{})
+	s.ErrorIs(err, ErrDegenerateProof)
+	s.False(verified)
+
+	invalidShare := *proof
+	for i := range invalidShare.ShareX {
+		invalidShare.ShareX[i] = 0xff
+	}
+	s.Error(invalidShare.Validate())
+
+	verified, err = rln.Verify(msg, invalidShare)
+	s.Error(err)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestSelfTest() {
+	rln := s.newRLN()
+
+	err := rln.InsertMember(IDCommitment{0x01}, 1)
+	s.NoError(err)
+
+	root1, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	report, err := rln.SelfTest()
+	s.NoError(err)
+	s.NotZero(report.Proof)
+	s.NotZero(report.Verify)
+	s.Equal(report.KeyGen+report.Witness+report.Proof+report.Verify, report.Total())
+
+	// tree is not modified
+	root2, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(root1, root2)
+	s.Equal(uint(1), rln.LeavesSet())
+}
+
+func (s *RLNSuite) TestVerifyThroughput() {
+	rln := s.newRLN()
+
+	report, err := rln.VerifyThroughput(8, 4)
+	s.NoError(err)
+	s.Equal(8, report.Samples)
+	s.Equal(4, report.Parallelism)
+	s.NotZero(report.Elapsed)
+	s.Greater(report.PerSecond, float64(0))
+
+	// tree is not modified
+	s.Equal(uint(0), rln.LeavesSet())
+
+	_, err = rln.VerifyThroughput(0, 1)
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestRecoverSlashingEvidence() {
+	epoch := ToEpoch(1000)
+
+	// same message id in the same epoch for different messages
+	rln, memKeys, proof1 := s.newRLNWithProof([]byte("Hello"), epoch, 1)
+
+	proof2, err := rln.GenerateProof([]byte("World"), *memKeys, MembershipIndex(0), epoch, 1)
+	s.NoError(err)
+
+	evidence, err := rln.RecoverSlashingEvidence(*proof1, *proof2)
+	s.NoError(err)
+	s.Equal(memKeys.IDSecretHash, evidence.Secret)
+	s.Equal(proof1.Nullifier, evidence.Nullifier)
+	s.Equal([2]MerkleNode{proof1.ShareX, proof1.ShareY}, evidence.Share1)
+	s.Equal([2]MerkleNode{proof2.ShareX, proof2.ShareY}, evidence.Share2)
+
+	var decoded SlashingEvidence
+	err = decoded.Decode(evidence.Encode())
+	s.NoError(err)
+	s.Equal(*evidence, decoded)
+
+	s.Error(decoded.Decode([]byte{0x01}))
+
+	// different message id
+	proof3, err := rln.GenerateProof([]byte("World"), *memKeys, MembershipIndex(0), epoch, 2)
+	s.NoError(err)
+
+	_, err = rln.RecoverSlashingEvidence(*proof1, *proof3)
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestGenerateProofHashedSignal() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	msg := bytes.Repeat([]byte{0x42}, 4096)
+	epoch := ToEpoch(1000)
+
+	proof, err := rln.GenerateProofHashedSignal(msg, *memKeys, MembershipIndex(0), epoch, 1)
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	verified, err := rln.VerifyHashedSignal(msg, *proof, root)
+	s.NoError(err)
+	s.True(verified)
+
+	// the proof is not valid for the unhashed signal
+	verified, err = rln.Verify(msg, *proof, root)
+	s.NoError(err)
+	s.False(verified)
+
+	verified, err = rln.VerifyHashedSignal([]byte("other message"), *proof, root)
+	s.NoError(err)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestInsertMemberReturningIndex() {
+	rln := s.newRLN()
+
+	for i := 0; i < 3; i++ {
+		memKeys, err := rln.MembershipKeyGen()
+		s.NoError(err)
+
+		index, err := rln.InsertMemberReturningIndex(memKeys.IDCommitment, memKeys.UserMessageLimit)
+		s.NoError(err)
+		s.Equal(MembershipIndex(i), index)
+	}
+
+	// a leaf set further in the tree moves the next insertion after it
+	err := rln.InsertLeafHash(MembershipIndex(10), MerkleNode{1})
+	s.NoError(err)
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	index, err := rln.InsertMemberReturningIndex(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+	s.Equal(MembershipIndex(11), index)
+
+	proof, err := rln.GenerateProof([]byte("Hello"), *memKeys, index, ToEpoch(1000), 1)
+	s.NoError(err)
+
+	verified, err := rln.Verify([]byte("Hello"), *proof)
+	s.NoError(err)
+	s.True(verified)
+}
+
+func (s *RLNSuite) TestInsertMemberReturningIndexConcurrent() {
+	rln := s.newRLN()
+
+	const members = 20
+	indices := make([]MembershipIndex, members)
+	errs := make([]error, members)
+
+	var wg sync.WaitGroup
+	for i := 0; i < members; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			indices[i], errs[i] = rln.InsertMemberReturningIndex(IDCommitment{byte(i + 1)}, 1)
+		}(i)
+	}
+	wg.Wait()
+
+	// every member got its own index, holding its leaf
+	seen := make(map[MembershipIndex]bool)
+	for i, index := range indices {
+		s.NoError(errs[i])
+		s.False(seen[index])
+		seen[index] = true
+
+		ok, err := rln.CheckMembership(index, IdentityCredential{IDCommitment: IDCommitment{byte(i + 1)}, UserMessageLimit: 1})
+		s.NoError(err)
+		s.True(ok)
+	}
+	s.Equal(uint(members), rln.LeavesSet())
+}
+
+func (s *RLNSuite) TestIsCurrentRoot() {
+	rln := s.newRLN()
+
+	root1, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	isCurrent, err := rln.IsCurrentRoot(root1)
+	s.NoError(err)
+	s.True(isCurrent)
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	isCurrent, err = rln.IsCurrentRoot(root1)
+	s.NoError(err)
+	s.False(isCurrent)
+
+	root2, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	isCurrent, err = rln.IsCurrentRoot(root2)
+	s.NoError(err)
+	s.True(isCurrent)
+}
+
+func (s *RLNSuite) TestReadOnly() {
+	rln := s.newRLN()
+
+	ro := rln.ReadOnly()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	// changes done through the rln instance are visible in the view
+	roRoot, err := ro.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(root, roRoot)
+
+	merkleProof, err := rln.GetMerkleProof(0)
+	s.NoError(err)
+	roMerkleProof, err := ro.GetMerkleProof(0)
+	s.NoError(err)
+	s.Equal(merkleProof, roMerkleProof)
+
+	msg := []byte("Hello")
+	proof, err := rln.GenerateProof(msg, *memKeys, MembershipIndex(0), ToEpoch(1000), 0)
+	s.NoError(err)
+
+	verified, err := ro.Verify(msg, *proof, root)
+	s.NoError(err)
+	s.True(verified)
+
+	results, err := ro.BatchVerifyPerItemRoots([]VerifyItemWithRoots{
+		{Data: msg, Proof: *proof, Roots: [][32]byte{root}},
+		{Data: []byte("other"), Proof: *proof, Roots: [][32]byte{root}},
+	})
+	s.NoError(err)
+	s.Equal([]bool{true, false}, results)
+}
+
+func (s *RLNSuite) TestGenerateProofTimeout() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	msg := []byte("Hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	proof, err := rln.GenerateProofTimeout(ctx, msg, *memKeys, MembershipIndex(0), ToEpoch(1000), 0)
+	s.NoError(err)
+
+	verified, err := rln.Verify(msg, *proof)
+	s.NoError(err)
+	s.True(verified)
+
+	cancelledCtx, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+
+	_, err = rln.GenerateProofTimeout(cancelledCtx, msg, *memKeys, MembershipIndex(0), ToEpoch(1000), 0)
+	s.ErrorIs(err, context.Canceled)
+
+	expiredCtx, cancel3 := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel3()
+	<-expiredCtx.Done()
+
+	_, err = rln.GenerateProofTimeout(expiredCtx, msg, *memKeys, MembershipIndex(0), ToEpoch(1000), 0)
+	s.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func (s *RLNSuite) TestInsertMembersWithLimits() {
+	rln := s.newRLN()
+
+	var members []IDCommitmentWithLimit
+	var keys []*IdentityCredential
+	for _, limit := range []uint32{1, 10, 100} {
+		memKeys, err := rln.MembershipKeyGen(limit)
+		s.NoError(err)
+		keys = append(keys, memKeys)
+		members = append(members, IDCommitmentWithLimit{IDCommitment: memKeys.IDCommitment, UserMessageLimit: limit})
+	}
+
+	err := rln.InsertMembersWithLimits(MembershipIndex(2), members)
+	s.NoError(err)
+	s.Equal(uint(5), rln.LeavesSet())
+
+	for i, m := range members {
+		leaf, err := rln.GetLeaf(MembershipIndex(2 + i))
+		s.NoError(err)
+		expected, err := rln.hashLeaf(m.IDCommitment, m.UserMessageLimit)
+		s.NoError(err)
+		s.Equal(expected, leaf)
+	}
+
+	msg := []byte("Hello")
+	proof, err := rln.GenerateProof(msg, *keys[2], MembershipIndex(4), ToEpoch(1000), 99)
+	s.NoError(err)
+
+	verified, err := rln.Verify(msg, *proof)
+	s.NoError(err)
+	s.True(verified)
+}
+
+func (s *RLNSuite) TestVerifyValidatesRoots() {
+	msg := []byte("Hello")
+	rln, _, proof := s.newRLNWithProof(msg, ToEpoch(1000), 0)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	// duplicated roots are accepted
+	verified, err := rln.Verify(msg, *proof, root, [32]byte{0x01}, root)
+	s.NoError(err)
+	s.True(verified)
+
+	var invalidRoot [32]byte
+	for i := range invalidRoot {
+		invalidRoot[i] = 0xff
+	}
+
+	verified, err = rln.Verify(msg, *proof, root, invalidRoot)
+	s.ErrorIs(err, ErrInvalidRoot)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestBuildTree() {
+	leaves := []IDCommitment{{0x01}, {0x02}, {0x03}}
+	limits := []uint32{1, 10, 100}
+
+	rln, roots, err := BuildTree(TreeDepth20, leaves, limits)
+	s.NoError(err)
+	s.Len(roots, 3)
+	s.Equal(uint(3), rln.LeavesSet())
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(root, roots[2])
+
+	// the intermediate roots are the ones of a tree with the first members
+	other := s.newRLN()
+	for i := range roots {
+		err := other.InsertMember(leaves[i], limits[i])
+		s.NoError(err)
+
+		partialRoot, err := other.GetMerkleRoot()
+		s.NoError(err)
+		s.Equal(roots[i], partialRoot)
+	}
+	s.NotEqual(roots[0], roots[1])
+
+	_, _, err = BuildTree(TreeDepth20, leaves, limits[:2])
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestAssertRoot() {
+	rln := s.newRLN()
+
+	emptyRoot, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.NoError(rln.AssertRoot(emptyRoot))
+
+	err = rln.InsertMember(IDCommitment{0x01}, 1)
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	err = rln.AssertRoot(emptyRoot)
+	var mismatch *ErrRootMismatch
+	s.ErrorAs(err, &mismatch)
+	s.Equal(root, mismatch.Got)
+	s.Equal(emptyRoot, mismatch.Want)
+}
+
+func (s *RLNSuite) TestEpochWindow() {
+	window := EpochWindow{EpochSize: 10, MaxEpochGap: 1}
+	now := time.Unix(1005, 0)
+
+	s.Equal([]Epoch{ToEpoch(99), ToEpoch(100), ToEpoch(101)}, window.Epochs(now))
+	s.True(window.Contains(ToEpoch(99), now))
+	s.True(window.Contains(ToEpoch(101), now))
+	s.False(window.Contains(ToEpoch(98), now))
+	s.False(window.Contains(ToEpoch(102), now))
+
+	s.Equal([]Epoch{ToEpoch(0), ToEpoch(1)}, window.Epochs(time.Unix(5, 0)))
+}
+
+func (s *RLNSuite) TestNullifierLog() {
+	log := NewNullifierLog()
+
+	proof1 := RateLimitProof{Nullifier: Nullifier{0x01}, ShareX: MerkleNode{0x01}}
+	proof2 := RateLimitProof{Nullifier: Nullifier{0x01}, ShareX: MerkleNode{0x02}}
+	proof3 := RateLimitProof{Nullifier: Nullifier{0x03}}
+
+	previous, seen := log.Add(ToEpoch(1), proof1)
+	s.False(seen)
+	s.Nil(previous)
+
+	previous, seen = log.Add(ToEpoch(1), proof2)
+	s.True(seen)
+	s.Equal(proof1, *previous)
+
+	_, seen = log.Add(ToEpoch(2), proof3)
+	s.False(seen)
+	s.Equal(2, log.Len())
+
+	log.Prune(ToEpoch(2))
+	s.Equal(1, log.Len())
+
+	_, seen = log.Add(ToEpoch(1), proof2)
+	s.False(seen)
+}
+
+func (s *RLNSuite) TestNullifierLogSnapshot() {
+	log := NewNullifierLog()
+
+	proof1 := RateLimitProof{Nullifier: Nullifier{0x01}, ShareX: MerkleNode{0x01}}
+	proof2 := RateLimitProof{Nullifier: Nullifier{0x02}, ShareX: MerkleNode{0x02}}
+	proof3 := RateLimitProof{Nullifier: Nullifier{0x01}, ShareX: MerkleNode{0x03}}
+
+	log.Add(ToEpoch(1), proof1)
+	log.Add(ToEpoch(1), proof2)
+	log.Add(ToEpoch(2), proof3)
+
+	snapshot := log.Snapshot()
+
+	restored, err := RestoreNullifierLog(snapshot)
+	s.NoError(err)
+	s.Equal(3, restored.Len())
+
+	previous, seen := restored.Add(ToEpoch(2), RateLimitProof{Nullifier: Nullifier{0x01}})
+	s.True(seen)
+	s.Equal(proof3, *previous)
+
+	// the epochs are kept, so old proofs are still pruned
+	restored.Prune(ToEpoch(2))
+	s.Equal(1, restored.Len())
+
+	restored, err = RestoreNullifierLog(NewNullifierLog().Snapshot())
+	s.NoError(err)
+	s.Equal(0, restored.Len())
+
+	_, err = RestoreNullifierLog(snapshot[:len(snapshot)-1])
+	s.Error(err)
+
+	_, err = RestoreNullifierLog(snapshot[:4])
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestRateLimiter() {
+	window := EpochWindow{EpochSize: 10, MaxEpochGap: 2}
+	now := time.Unix(10005, 0)
+	epoch := CalcEpoch(now, window.EpochSize)
+
+	rln, memKeys, proof1 := s.newRLNWithProof([]byte("Hello"), epoch, 1)
+
+	_, err := NewRateLimiter(rln, NewNullifierLog(), EpochWindow{EpochSize: 0, MaxEpochGap: 20})
+	s.Error(err)
+
+	limiter, err := NewRateLimiter(rln, NewNullifierLog(), window)
+	s.NoError(err)
+
+	result, evidence, err := limiter.Check([]byte("Hello"), *proof1, now)
+	s.NoError(err)
+	s.Equal(CheckAllowed, result)
+	s.Nil(evidence)
+
+	result, _, err = limiter.Check([]byte("Hello"), *proof1, now)
+	s.NoError(err)
+	s.Equal(CheckDuplicate, result)
+
+	result, _, err = limiter.Check([]byte("Other"), *proof1, now)
+	s.NoError(err)
+	s.Equal(CheckInvalid, result)
+
+	// a different message with the same message id in the same epoch
+	proof2, err := rln.GenerateProof([]byte("World"), *memKeys, MembershipIndex(0), epoch, 1)
+	s.NoError(err)
+
+	result, evidence, err = limiter.Check([]byte("World"), *proof2, now)
+	s.NoError(err)
+	s.Equal(CheckSpam, result)
+	s.Equal(memKeys.IDSecretHash, evidence.Secret)
+
+	proof3, err := rln.GenerateProof([]byte("Hello"), *memKeys, MembershipIndex(0), ToEpoch(1), 1)
+	s.NoError(err)
+
+	result, _, err = limiter.Check([]byte("Hello"), *proof3, now)
+	s.NoError(err)
+	s.Equal(CheckOutOfWindow, result)
+
+	// the first proof is out of the window some epochs later
+	result, _, err = limiter.Check([]byte("Hello"), *proof1, now.Add(time.Minute))
+	s.NoError(err)
+	s.Equal(CheckOutOfWindow, result)
+}
+
+func (s *RLNSuite) TestGetMemberLimit() {
+	rln := s.newRLN()
+
+	err := rln.InsertMember(IDCommitment{0x01}, 5)
+	s.NoError(err)
+
+	err = rln.InsertMembersWithLimits(MembershipIndex(1), []IDCommitmentWithLimit{
+		{IDCommitment: IDCommitment{0x02}, UserMessageLimit: 10},
+		{IDCommitment: IDCommitment{0x03}, UserMessageLimit: 20},
+	})
+	s.NoError(err)
+
+	for index, expected := range []uint32{5, 10, 20} {
+		limit, ok, err := rln.GetMemberLimit(MembershipIndex(index))
+		s.NoError(err)
+		s.True(ok)
+		s.Equal(expected, limit)
+	}
+
+	// unknown member
+	_, ok, err := rln.GetMemberLimit(MembershipIndex(3))
+	s.NoError(err)
+	s.False(ok)
+
+	// the leaf was replaced without a limit
+	err = rln.InsertMemberAt(MembershipIndex(1), IDCommitment{0x04})
+	s.NoError(err)
+
+	_, ok, err = rln.GetMemberLimit(MembershipIndex(1))
+	s.NoError(err)
+	s.False(ok)
+}
+
+func (s *RLNSuite) TestSignalHasher() {
+	hasher := func(data []byte) []byte {
+		return Keccak256(data)
+	}
+
+	rln, err := NewRLNWithOptions(TreeDepth20, WithSignalHasher(hasher))
+	s.NoError(err)
+
+	defaultRLN := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+	err = defaultRLN.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	msg := []byte("Hello")
+	epoch := ToEpoch(1000)
+
+	proof, err := rln.GenerateProof(msg, *memKeys, MembershipIndex(0), epoch, 1)
+	s.NoError(err)
+
+	verified, err := rln.Verify(msg, *proof)
+	s.NoError(err)
+	s.True(verified)
+
+	// an instance without the hasher sees a different signal
+	verified, err = defaultRLN.Verify(msg, *proof)
+	s.NoError(err)
+	s.False(verified)
+
+	verified, err = defaultRLN.Verify(hasher(msg), *proof)
+	s.NoError(err)
+	s.True(verified)
+
+	// the witness uses the same signal
+	merkleProof, err := rln.GetMerkleProof(0)
+	s.NoError(err)
+
+	witness, err := rln.CreateWitness(memKeys.IDSecretHash, memKeys.UserMessageLimit, 1, msg, epoch, merkleProof)
+	s.NoError(err)
+
+	witnessProof, err := rln.GenerateRLNProofWithWitness(witness)
+	s.NoError(err)
+	s.True(ProofsAgree(*proof, *witnessProof))
+}
+
+func (s *RLNSuite) TestGetLeavesByIndex() {
+	rln := s.newRLN()
+
+	for i := 0; i < 5; i++ {
+		err := rln.InsertMemberAt(MembershipIndex(i), IDCommitment{byte(i + 1)})
+		s.NoError(err)
+	}
+
+	leaves, err := rln.GetLeavesByIndex([]MembershipIndex{4, 0, 2, 9})
+	s.NoError(err)
+	s.Equal([]IDCommitment{{0x05}, {0x01}, {0x03}, {}}, leaves)
+
+	_, err = rln.GetLeavesByIndex([]MembershipIndex{0, 1 << 20})
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestVerifyExpectingNullifier() {
+	msg := []byte("Hello")
+	epoch := ToEpoch(1000)
+	rln, _, proof := s.newRLNWithProof(msg, epoch, 1)
+
+	expected, err := rln.Poseidon(epoch[:], RLN_IDENTIFIER[:])
+	s.NoError(err)
+
+	verified, err := rln.VerifyExpectingNullifier(msg, *proof, expected)
+	s.NoError(err)
+	s.True(verified)
+
+	otherEpoch := ToEpoch(1001)
+	other, err := rln.Poseidon(otherEpoch[:], RLN_IDENTIFIER[:])
+	s.NoError(err)
+
+	verified, err = rln.VerifyExpectingNullifier(msg, *proof, other)
+	s.ErrorIs(err, ErrExternalNullifierMismatch)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestAtomicOperationWithMetadata() {
+	rln := s.newRLN()
+
+	err := rln.InsertMembers(0, []IDCommitment{{0x01}, {0x02}})
+	s.NoError(err)
+
+	err = rln.AtomicOperationWithMetadata(2, []IDCommitment{{0x03}, {0x04}}, []MembershipIndex{0}, []byte{0xaa})
+	s.NoError(err)
+
+	leaves, err := rln.GetLeavesByIndex([]MembershipIndex{0, 1, 2, 3})
+	s.NoError(err)
+	s.Equal([]IDCommitment{{}, {0x02}, {0x03}, {0x04}}, leaves)
+
+	metadata, err := rln.GetMetadata()
+	s.NoError(err)
+	s.Equal([]byte{0xaa}, metadata)
+
+	// removals and insertions far apart only touch their own leaves
+	err = rln.AtomicOperationWithMetadata(50000, []IDCommitment{{0x05}}, []MembershipIndex{1, 3}, []byte{0xab})
+	s.NoError(err)
+
+	leaves, err = rln.GetLeavesByIndex([]MembershipIndex{0, 1, 2, 3, 49999, 50000})
+	s.NoError(err)
+	s.Equal([]IDCommitment{{}, {}, {0x03}, {}, {}, {0x05}}, leaves)
+	s.Equal(uint(50001), rln.LeavesSet())
+
+	metadata, err = rln.GetMetadata()
+	s.NoError(err)
+	s.Equal([]byte{0xab}, metadata)
+
+	// the metadata is not updated when the tree operation fails
+	err = rln.AtomicOperationWithMetadata(1<<20, []IDCommitment{{0x05}}, nil, []byte{0xbb})
+	s.Error(err)
+
+	metadata, err = rln.GetMetadata()
+	s.NoError(err)
+	s.Equal([]byte{0xab}, metadata)
+
+	// if the metadata can't be stored, the operation is reverted
+	revert, err := rln.atomicOperation(1, []IDCommitment{{0x06}, {0x07}}, []MembershipIndex{0, 2})
+	s.NoError(err)
+	s.NoError(revert())
+
+	leaves, err = rln.GetLeavesByIndex([]MembershipIndex{0, 1, 2, 3})
+	s.NoError(err)
+	s.Equal([]IDCommitment{{}, {}, {0x03}, {}}, leaves)
+}
+
+func (s *RLNSuite) TestInsertMembersWithLimitFn() {
+	rln := s.newRLN()
+
+	limits := map[IDCommitment]uint32{
+		{0x01}: 5,
+		{0x02}: 50,
+	}
+	limitFn := func(idComm IDCommitment) (uint32, error) {
+		limit, ok := limits[idComm]
+		if !ok {
+			return 0, errors.New("unknown member")
+		}
+		return limit, nil
+	}
+
+	err := rln.InsertMembersWithLimitFn(0, []IDCommitment{{0x01}, {0x02}}, limitFn)
+	s.NoError(err)
+
+	for i, idComm := range []IDCommitment{{0x01}, {0x02}} {
+		leaf, err := rln.GetLeaf(MembershipIndex(i))
+		s.NoError(err)
+		expected, err := rln.hashLeaf(idComm, limits[idComm])
+		s.NoError(err)
+		s.Equal(expected, leaf)
+
+		limit, ok, err := rln.GetMemberLimit(MembershipIndex(i))
+		s.NoError(err)
+		s.True(ok)
+		s.Equal(limits[idComm], limit)
+	}
+
+	err = rln.InsertMembersWithLimitFn(2, []IDCommitment{{0x03}}, limitFn)
+	s.Error(err)
+	s.Equal(uint(2), rln.LeavesSet())
+
+	// with InsertMembers the commitments are the leaves
+	err = rln.InsertMembers(2, []IDCommitment{{0x03}})
+	s.NoError(err)
+
+	leaf, err := rln.GetLeaf(2)
+	s.NoError(err)
+	s.Equal(IDCommitment{0x03}, leaf)
+}
+
+func (s *RLNSuite) TestProofInputBytes() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	msg := []byte("Hello")
+	epoch := ToEpoch(1000)
+
+	input, err := rln.ProofInputBytes(msg, *memKeys, MembershipIndex(7), epoch, 3)
+	s.NoError(err)
+
+	externalNullifier, err := rln.Poseidon(epoch[:], RLN_IDENTIFIER[:])
+	s.NoError(err)
+
+	// [ identity_secret<32> | id_index<8> | user_message_limit<32> | message_id<32> | external_nullifier<32> | signal_len<8> | signal<var> ]
+	s.Len(input, 32+8+32+32+32+8+len(msg))
+	s.Equal(memKeys.IDSecretHash[:], input[0:32])
+	s.Equal(uint64(7), binary.LittleEndian.Uint64(input[32:40]))
+	s.Equal(memKeys.UserMessageLimit, binary.LittleEndian.Uint32(input[40:44]))
+	s.Equal(uint32(3), binary.LittleEndian.Uint32(input[72:76]))
+	s.Equal(externalNullifier[:], input[104:136])
+	s.Equal(uint64(len(msg)), binary.LittleEndian.Uint64(input[136:144]))
+	s.Equal(msg, input[144:])
+}
+
+func (s *RLNSuite) TestLeafHashes() {
+	rln := s.newRLN()
+
+	leafHashes, err := rln.LeafHashes()
+	s.NoError(err)
+	s.Empty(leafHashes)
+
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	err = rln.InsertMemberAt(3, IDCommitment{0x03})
+	s.NoError(err)
+
+	leafHashes, err = rln.LeafHashes()
+	s.NoError(err)
+
+	hashedLeaf, err := rln.hashLeaf(IDCommitment{0x01}, 10)
+	s.NoError(err)
+	s.Equal([]MerkleNode{hashedLeaf, {}, {}, {0x03}}, leafHashes)
+
+	// the root can be recomputed from the leaves
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	calculatedRoot, err := CalcMerkleRoot(leafHashes)
+	s.NoError(err)
+	s.Equal(root, calculatedRoot)
+}
+
+func (s *RLNSuite) TestSubtreeRoot() {
+	rln := s.newRLN()
+
+	for i := 0; i < 8; i++ {
+		err := rln.InsertMemberAt(MembershipIndex(i), IDCommitment{byte(i + 1)})
+		s.NoError(err)
+	}
+
+	merkleProof, err := rln.GetMerkleProof(0)
+	s.NoError(err)
+
+	// the siblings in the path of leaf 0 are the roots of the subtrees next to it
+	subtreeRoot, err := rln.SubtreeRoot(1, 1)
+	s.NoError(err)
+	s.Equal(merkleProof.PathElements[0], subtreeRoot)
+
+	subtreeRoot, err = rln.SubtreeRoot(2, 2)
+	s.NoError(err)
+	s.Equal(merkleProof.PathElements[1], subtreeRoot)
+
+	subtreeRoot, err = rln.SubtreeRoot(4, 4)
+	s.NoError(err)
+	s.Equal(merkleProof.PathElements[2], subtreeRoot)
+
+	_, err = rln.SubtreeRoot(0, 3)
+	s.Error(err)
+
+	_, err = rln.SubtreeRoot(2, 4)
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestCalcMerkleRootWithDepth() {
+	list := []IDCommitment{{0x01}, {0x02}, {0x03}}
+
+	root15, err := CalcMerkleRootWithDepth(list, TreeDepth15)
+	s.NoError(err)
+
+	rln15 := s.newRLNWithDepth(TreeDepth15)
+	err = rln15.InsertMembers(0, list)
+	s.NoError(err)
+
+	expectedRoot, err := rln15.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(expectedRoot, root15)
+
+	rln20 := s.newRLN()
+	err = rln20.InsertMembers(0, list)
+	s.NoError(err)
+
+	root20, err := rln20.GetMerkleRoot()
+	s.NoError(err)
+	s.NotEqual(root20, root15)
+
+	_, err = CalcMerkleRootWithDepth(make([]IDCommitment, 1<<15+1), TreeDepth15)
+	s.ErrorIs(err, ErrTreeFull)
+}
+
+func (s *RLNSuite) TestMembershipKeyGenFrom() {
+	rln := s.newRLN()
+
+	seed := bytes.Repeat([]byte{0x2a}, 32)
+
+	key1, err := rln.MembershipKeyGenFrom(bytes.NewReader(seed), 5)
+	s.NoError(err)
+	s.Equal(uint32(5), key1.UserMessageLimit)
+
+	key2, err := rln.MembershipKeyGenFrom(bytes.NewReader(seed), 5)
+	s.NoError(err)
+	s.True(IdentityCredentialEquals(*key1, *key2))
+
+	seededKey, err := rln.SeededMembershipKeyGen(seed, 5)
+	s.NoError(err)
+	s.True(IdentityCredentialEquals(*key1, *seededKey))
+
+	// not enough entropy
+	_, err = rln.MembershipKeyGenFrom(bytes.NewReader(seed[:31]), 5)
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestDeriveCredential() {
+	rln := s.newRLN()
+
+	seed := []byte("master seed")
+
+	key0, err := rln.DeriveCredential(seed, 0, 10)
+	s.NoError(err)
+	s.Equal(uint32(10), key0.UserMessageLimit)
+
+	key1, err := rln.DeriveCredential(seed, 1, 10)
+	s.NoError(err)
+	s.NotEqual(key0.IDCommitment, key1.IDCommitment)
+
+	again, err := rln.DeriveCredential(seed, 1, 10)
+	s.NoError(err)
+	s.True(IdentityCredentialEquals(*key1, *again))
+
+	seededKey, err := rln.SeededMembershipKeyGen(append([]byte("master seed"), 1, 0, 0, 0), 10)
+	s.NoError(err)
+	s.True(IdentityCredentialEquals(*key1, *seededKey))
+
+	// the seed received is not modified
+	s.Equal([]byte("master seed"), seed)
+}
+
+func (s *RLNSuite) TestVerifyWithEpoch() {
+	window := EpochWindow{EpochSize: 10, MaxEpochGap: 1}
+	now := time.Unix(10005, 0)
+	epoch := CalcEpoch(now, window.EpochSize)
+
+	msg := []byte("Hello")
+	rln, _, proof := s.newRLNWithProof(msg, epoch, 1)
+
+	verified, err := rln.VerifyWithEpoch(msg, *proof, epoch, window, now)
+	s.NoError(err)
+	s.True(verified)
+
+	// the claimed epoch is within the window, but the proof was not generated for it
+	verified, err = rln.VerifyWithEpoch(msg, *proof, ToEpoch(epoch.Uint64()+1), window, now)
+	s.ErrorIs(err, ErrExternalNullifierMismatch)
+	s.False(verified)
+
+	// the proof is too old
+	verified, err = rln.VerifyWithEpoch(msg, *proof, epoch, window, now.Add(time.Minute))
+	s.ErrorIs(err, ErrEpochOutOfWindow)
+	s.False(verified)
+
+	// a window with a zero epoch size is rejected
+	verified, err = rln.VerifyWithEpoch(msg, *proof, epoch, EpochWindow{MaxEpochGap: 1}, now)
+	s.Error(err)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestTreeInfo() {
+	rln := s.newRLN()
+
+	info, err := rln.TreeInfo(true)
+	s.NoError(err)
+	s.Equal(TreeInfo{Capacity: 1 << 20}, info)
+
+	err = rln.InsertMemberAt(3, IDCommitment{0x03})
+	s.NoError(err)
+
+	err = rln.InsertMemberAt(4, IDCommitment{0x04})
+	s.NoError(err)
+
+	err = rln.DeleteMember(4)
+	s.NoError(err)
+
+	info, err = rln.TreeInfo(true)
+	s.NoError(err)
+	s.Equal(uint(5), info.LeavesSet)
+	s.Equal(uint64(1<<20), info.Capacity)
+	s.Equal(float64(5)/(1<<20), info.FillRatio)
+	s.Equal(uint(4), info.ZeroLeaves)
+
+	// the leaves are not read unless requested
+	info, err = rln.TreeInfo(false)
+	s.NoError(err)
+	s.Equal(uint(5), info.LeavesSet)
+	s.Equal(uint(0), info.ZeroLeaves)
+}
+
+func (s *RLNSuite) TestSnapshot() {
+	rln := s.newRLN()
+
+	err := rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	err = rln.InsertMemberAt(3, IDCommitment{0x03})
+	s.NoError(err)
+
+	err = rln.SetMetadata([]byte{1, 2, 3})
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	restored := s.newRLN()
+
+	for _, format := range []SnapshotFormat{SnapshotBinary, SnapshotJSON} {
+		snapshot, err := rln.Snapshot(format)
+		s.NoError(err)
+		s.Equal(byte(format), snapshot[5])
+
+		// the snapshot replaces the leaves of a tree with more leaves set
+		err = restored.InsertMemberAt(5, IDCommitment{0x05})
+		s.NoError(err)
+
+		err = restored.RestoreSnapshot(snapshot, format)
+		s.NoError(err)
+
+		restoredRoot, err := restored.GetMerkleRoot()
+		s.NoError(err)
+		s.Equal(root, restoredRoot)
+
+		metadata, err := restored.GetMetadata()
+		s.NoError(err)
+		s.Equal([]byte{1, 2, 3}, metadata)
+
+		// the format in the header must match
+		err = restored.RestoreSnapshot(snapshot, 1-format)
+		s.ErrorIs(err, ErrInvalidSnapshot)
+
+		err = restored.RestoreSnapshot(snapshot[:len(snapshot)-1], format)
+		s.ErrorIs(err, ErrInvalidSnapshot)
+	}
+}
+
+func (s *RLNSuite) TestBatchVerifySameRoot() {
+	rln := s.newRLN()
+
+	var memKeys []*IdentityCredential
+	for i := 0; i < 2; i++ {
+		keys, err := rln.MembershipKeyGen()
+		s.NoError(err)
+
+		err = rln.InsertMember(keys.IDCommitment, keys.UserMessageLimit)
+		s.NoError(err)
+
+		memKeys = append(memKeys, keys)
+	}
+
+	msg := []byte("Hello")
+	proof1, err := rln.GenerateProof(msg, *memKeys[0], MembershipIndex(0), ToEpoch(1000), 0)
+	s.NoError(err)
+
+	proof2, err := rln.GenerateProof(msg, *memKeys[1], MembershipIndex(1), ToEpoch(1000), 0)
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	// the root changes, so the last proof carries a different one
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	proof3, err := rln.GenerateProof(msg, *memKeys[0], MembershipIndex(0), ToEpoch(1000), 1)
+	s.NoError(err)
+
+	// a malformed proof claiming the right root
+	malformed := RateLimitProof{MerkleRoot: root}
+
+	result, err := rln.BatchVerifySameRoot([]VerifyItem{
+		{Data: msg, Proof: *proof1},
+		{Data: []byte("Bye"), Proof: *proof2},
+		{Data: msg, Proof: *proof3},
+		{Data: msg, Proof: malformed},
+		{Data: msg, Proof: *proof2},
+	}, root)
+	s.NoError(err)
+	s.Equal([]bool{true, false, false, false, true}, result)
+}
+
+func (s *RLNSuite) TestValidateCredential() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	valid, err := rln.ValidateCredential(*memKeys)
+	s.NoError(err)
+	s.True(valid)
+
+	corrupted := *memKeys
+	corrupted.IDNullifier[0] ^= 0x01
+	valid, err = rln.ValidateCredential(corrupted)
+	s.NoError(err)
+	s.False(valid)
+
+	forged := *memKeys
+	forged.IDCommitment = IDCommitment{0x01}
+	valid, err = rln.ValidateCredential(forged)
+	s.NoError(err)
+	s.False(valid)
+}
+
+func (s *RLNSuite) TestHighWaterMark() {
+	rln := s.newRLN()
+	s.Equal(MembershipIndex(0), rln.HighWaterMark())
+
+	for _, index := range []MembershipIndex{0, 1, 5} {
+		err := rln.InsertMemberAt(index, IDCommitment{byte(index + 1)})
+		s.NoError(err)
+	}
+	s.Equal(MembershipIndex(6), rln.HighWaterMark())
+	s.Equal(uint(6), rln.LeavesSet())
+
+	// inserting below the mark doesn't change it
+	err := rln.InsertMemberAt(3, IDCommitment{0x04})
+	s.NoError(err)
+	s.Equal(MembershipIndex(6), rln.HighWaterMark())
+
+	// deleting the highest member doesn't lower it
+	err = rln.DeleteMember(5)
+	s.NoError(err)
+	s.Equal(MembershipIndex(6), rln.HighWaterMark())
+
+	// the next member is appended at the mark
+	index, err := rln.InsertMemberReturningIndex(IDCommitment{0x07}, 10)
+	s.NoError(err)
+	s.Equal(MembershipIndex(6), index)
+	s.Equal(MembershipIndex(7), rln.HighWaterMark())
+}
+
+func (s *RLNSuite) TestSignalToField() {
+	msg := []byte("Hello")
+	rln, _, proof := s.newRLNWithProof(msg, ToEpoch(1000), 0)
+
+	signal, err := rln.SignalToField(msg)
+	s.NoError(err)
+	s.Equal(proof.ShareX, signal)
+
+	// the signal hasher is applied before mapping the data to the field
+	rln.signalHasher = func(b []byte) []byte { return append([]byte("prefix"), b...) }
+	signal, err = rln.SignalToField(msg)
+	s.NoError(err)
+	s.Equal(MerkleNode(HashToBN255([]byte("prefixHello"))), signal)
+}
+
+func (s *RLNSuite) TestSnapshotReadOnly() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	snapshotRoot, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	snapshot, err := rln.SnapshotReadOnly()
+	s.NoError(err)
+
+	// the original keeps changing
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	root, err := snapshot.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(snapshotRoot, root)
+
+	msg := []byte("Hello")
+	proof, err := snapshot.GenerateProof(msg, *memKeys, MembershipIndex(0), ToEpoch(1000), 0)
+	s.NoError(err)
+	s.Equal(snapshotRoot, proof.MerkleRoot)
+
+	currentRoot, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	// the proof is only accepted if the root of the snapshot is in the window
+	verified, err := rln.Verify(msg, *proof, currentRoot)
+	s.NoError(err)
+	s.False(verified)
+
+	verified, err = rln.Verify(msg, *proof, currentRoot, snapshotRoot)
+	s.NoError(err)
+	s.True(verified)
+}
+
+func (s *RLNSuite) TestVerifyAgainstTracker() {
+	msg := []byte("Hello")
+	rln, _, proof := s.newRLNWithProof(msg, ToEpoch(1000), 0)
+
+	_, err := NewRootTracker(0)
+	s.Error(err)
+
+	tracker, err := NewRootTracker(2)
+	s.NoError(err)
+
+	_, err = rln.VerifyAgainstTracker(msg, *proof, tracker)
+	s.Error(err)
+
+	s.NoError(tracker.Update(rln))
+	s.NoError(tracker.Update(rln))
+	s.Len(tracker.Roots(), 1)
+
+	verified, err := rln.VerifyAgainstTracker(msg, *proof, tracker)
+	s.NoError(err)
+	s.True(verified)
+
+	// the root of the proof is still in the window after one change
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+	s.NoError(tracker.Update(rln))
+
+	verified, err = rln.VerifyAgainstTracker(msg, *proof, tracker)
+	s.NoError(err)
+	s.True(verified)
+
+	// and evicted after two
+	err = rln.InsertMember(IDCommitment{0x02}, 10)
+	s.NoError(err)
+	s.NoError(tracker.Update(rln))
+
+	currentRoot, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	s.Len(tracker.Roots(), 2)
+	s.Equal([32]byte(currentRoot), tracker.Roots()[0])
+
+	verified, err = rln.VerifyAgainstTracker(msg, *proof, tracker)
+	s.NoError(err)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestComputeMerkleProof() {
+	rln := s.newRLN()
+
+	leaves := []MerkleNode{{0x01}, {0x02}, {}, {0x04}, {0x05}}
+	err := rln.InsertMembers(0, leaves)
+	s.NoError(err)
+
+	for _, index := range []MembershipIndex{0, 3, 4, 7} {
+		expected, err := rln.GetMerkleProof(index)
+		s.NoError(err)
+
+		proof, err := ComputeMerkleProof(leaves, index, DefaultTreeDepth, rln.Poseidon)
+		s.NoError(err)
+		s.Equal(expected, proof)
+	}
+
+	_, err = ComputeMerkleProof(leaves, 1<<20, DefaultTreeDepth, rln.Poseidon)
+	s.Error(err)
+
+	_, err = ComputeMerkleProof(leaves, 0, 2, rln.Poseidon)
+	s.ErrorIs(err, ErrTreeFull)
+}
+
+func (s *RLNSuite) TestSetDefaultUserMessageLimit() {
+	rln1 := s.newRLN()
+
+	rln2 := s.newRLN()
+
+	rln1.SetDefaultUserMessageLimit(20)
+
+	memKeys, err := rln1.MembershipKeyGen()
+	s.NoError(err)
+	s.Equal(uint32(20), memKeys.UserMessageLimit)
+
+	memKeys, err = rln1.SeededMembershipKeyGen([]byte("seed"))
+	s.NoError(err)
+	s.Equal(uint32(20), memKeys.UserMessageLimit)
+
+	// an explicit limit takes precedence
+	memKeys, err = rln1.MembershipKeyGen(5)
+	s.NoError(err)
+	s.Equal(uint32(5), memKeys.UserMessageLimit)
+
+	// other instances are not affected
+	memKeys, err = rln2.MembershipKeyGen()
+	s.NoError(err)
+	s.Equal(DEFAULT_USER_MESSAGE_LIMIT, memKeys.UserMessageLimit)
+
+	rln1.SetDefaultUserMessageLimit(0)
+	memKeys, err = rln1.MembershipKeyGen()
+	s.NoError(err)
+	s.Equal(DEFAULT_USER_MESSAGE_LIMIT, memKeys.UserMessageLimit)
+}
+
+func (s *RLNSuite) TestGetMerkleProofForOccupied() {
+	rln := s.newRLN()
+
+	err := rln.InsertMemberAt(0, IDCommitment{0x01})
+	s.NoError(err)
+
+	err = rln.InsertMemberAt(5, IDCommitment{0x05})
+	s.NoError(err)
+
+	expected, err := rln.GetMerkleProof(5)
+	s.NoError(err)
+
+	proof, err := rln.GetMerkleProofForOccupied(5)
+	s.NoError(err)
+	s.Equal(expected, proof)
+
+	_, err = rln.GetMerkleProofForOccupied(1)
+	s.ErrorIs(err, ErrEmptyLeaf)
+
+	err = rln.DeleteMember(0)
+	s.NoError(err)
+
+	_, err = rln.GetMerkleProofForOccupied(0)
+	s.ErrorIs(err, ErrEmptyLeaf)
+}
+
+func (s *RLNSuite) TestCircuitFingerprint() {
+	rln1 := s.newRLN()
+
+	rln2 := s.newRLN()
+
+	fingerprint1, err := rln1.CircuitFingerprint()
+	s.NoError(err)
+	s.NotEqual([32]byte{}, fingerprint1)
+
+	fingerprint2, err := rln2.CircuitFingerprint()
+	s.NoError(err)
+	s.Equal(fingerprint1, fingerprint2)
+}
+
+func (s *RLNSuite) TestABIEncode() {
+	_, _, proof := s.newRLNWithProof([]byte("Hello"), ToEpoch(1000), 0)
+
+	encoded, err := proof.ABIEncode()
+	s.NoError(err)
+	s.Len(encoded, 8*32)
+
+	// the x coordinate of a is the one in the compressed proof, without the flags
+	x := Bytes32(proof.Proof[0:32])
+	x[31] &^= 0xc0
+	s.Equal(revert(x[:]), encoded[0:32])
+
+	// a point of b out of the subgroup
+	invalid := *proof
+	invalid.Proof[32] ^= 0x01
+	_, err = invalid.ABIEncode()
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestInitTreeFromChannel() {
+	rln := s.newRLN()
+
+	err := rln.InsertMember(IDCommitment{0xff}, 10)
+	s.NoError(err)
+
+	var members []IDCommitmentWithLimit
+	for i := 0; i < 2*initTreeChunkSize+10; i++ {
+		var idComm IDCommitment
+		binary.LittleEndian.PutUint32(idComm[:], uint32(i))
+		members = append(members, IDCommitmentWithLimit{IDCommitment: idComm, UserMessageLimit: uint32(i%5 + 1)})
+	}
+
+	// all the members are available at once, so they are inserted in full chunks
+	ch := make(chan IDCommitmentWithLimit, len(members))
+	for _, m := range members {
+		ch <- m
+	}
+	close(ch)
+
+	err = rln.InitTreeFromChannel(context.Background(), ch)
+	s.NoError(err)
+	s.Equal(uint(len(members)+1), rln.LeavesSet())
+
+	expected := s.newRLN()
+	err = expected.InsertMember(IDCommitment{0xff}, 10)
+	s.NoError(err)
+	err = expected.InsertMembersWithLimits(1, members)
+	s.NoError(err)
+
+	expectedRoot, err := expected.GetMerkleRoot()
+	s.NoError(err)
+	s.NoError(rln.AssertRoot(expectedRoot))
+
+	// the members received before the context is done are inserted
+	ctx, cancel := context.WithCancel(context.Background())
+	ch = make(chan IDCommitmentWithLimit, 1)
+	ch <- IDCommitmentWithLimit{IDCommitment: IDCommitment{0x01}, UserMessageLimit: 1}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	err = rln.InitTreeFromChannel(ctx, ch)
+	s.ErrorIs(err, context.Canceled)
+	s.Equal(uint(len(members)+2), rln.LeavesSet())
+}
+
+func (s *RLNSuite) TestInsertMembersIdempotent() {
+	rln := s.newRLN()
+
+	var members []IDCommitmentWithLimit
+	for i := 1; i <= 6; i++ {
+		members = append(members, IDCommitmentWithLimit{IDCommitment: IDCommitment{byte(i)}, UserMessageLimit: uint32(i)})
+	}
+
+	// a previous sync inserted some of the members
+	inserted, err := rln.InsertMembersIdempotent(0, members[:3])
+	s.NoError(err)
+	s.Equal(3, inserted)
+
+	inserted, err = rln.InsertMembersIdempotent(0, members)
+	s.NoError(err)
+	s.Equal(3, inserted)
+
+	inserted, err = rln.InsertMembersIdempotent(0, members)
+	s.NoError(err)
+	s.Equal(0, inserted)
+	s.Equal(uint(6), rln.LeavesSet())
+
+	expected := s.newRLN()
+	err = expected.InsertMembersWithLimits(0, members)
+	s.NoError(err)
+
+	expectedRoot, err := expected.GetMerkleRoot()
+	s.NoError(err)
+	s.NoError(rln.AssertRoot(expectedRoot))
+
+	limit, ok, err := rln.GetMemberLimit(5)
+	s.NoError(err)
+	s.True(ok)
+	s.Equal(uint32(6), limit)
+
+	// a different member at the same position is not overwritten
+	_, err = rln.InsertMembersIdempotent(5, []IDCommitmentWithLimit{{IDCommitment: IDCommitment{0x07}, UserMessageLimit: 1}})
+	s.ErrorIs(err, ErrLeafConflict)
+	s.NoError(rln.AssertRoot(expectedRoot))
+}
+
+func (s *RLNSuite) TestPackageHashes() {
+	rln := s.newRLN()
+
+	data := []byte("Hello")
+
+	expected, err := rln.Sha256(data)
+	s.NoError(err)
+
+	hash, err := Hash(data)
+	s.NoError(err)
+	s.Equal(expected, hash)
+
+	expected, err = rln.Poseidon(hash[:], hash[:])
+	s.NoError(err)
+
+	hash, err = PoseidonHash(hash[:], hash[:])
+	s.NoError(err)
+	s.Equal(expected, hash)
+}
+
+func (s *RLNSuite) TestUpdatedPathAfterInsert() {
+	rln := s.newRLN()
+
+	leaves := []IDCommitment{{0x01}, {0x02}, {0x03}, {0x04}}
+	err := rln.InsertMembers(0, leaves)
+	s.NoError(err)
+
+	proofsBefore, err := rln.GetMerkleProofs(leafRange(0, len(leaves)))
+	s.NoError(err)
+
+	err = rln.InsertMemberAt(2, IDCommitment{0x05})
+	s.NoError(err)
+
+	stale, err := rln.UpdatedPathAfterInsert(2)
+	s.NoError(err)
+	s.Equal([]MembershipIndex{0, 1, 3}, stale)
+
+	proofsAfter, err := rln.GetMerkleProofs(leafRange(0, len(leaves)))
+	s.NoError(err)
+
+	for i := range leaves {
+		if i == 2 {
+			s.Equal(proofsBefore[i], proofsAfter[i])
+		} else {
+			s.NotEqual(proofsBefore[i], proofsAfter[i])
+		}
+	}
+}
+
+func (s *RLNSuite) TestSignedSnapshot() {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	s.NoError(err)
+
+	rln := s.newRLN()
+
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	blob, err := rln.SignedSnapshot(priv)
+	s.NoError(err)
+
+	restored, err := VerifySignedSnapshot(blob, pub)
+	s.NoError(err)
+	s.NoError(restored.AssertRoot(root))
+
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	s.NoError(err)
+
+	_, err = VerifySignedSnapshot(blob, otherPub)
+	s.ErrorIs(err, ErrInvalidSnapshot)
+
+	tampered := append([]byte{}, blob...)
+	tampered[snapshotHeaderSize+1] ^= 0x01
+	_, err = VerifySignedSnapshot(tampered, pub)
+	s.ErrorIs(err, ErrInvalidSnapshot)
+}
+
+func (s *RLNSuite) TestTombstone() {
+	rln := s.newRLN()
+
+	err := rln.InsertMembers(0, []IDCommitment{{0x01}, {0x02}, {0x03}, {0x04}})
+	s.NoError(err)
+
+	// without a tombstone, deleted members are zero leaves
+	err = rln.DeleteMember(0)
+	s.NoError(err)
+
+	isTombstone, err := rln.IsTombstone(0)
+	s.NoError(err)
+	s.False(isTombstone)
+
+	err = rln.SetTombstone(MerkleNode{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	s.Error(err)
+
+	tombstone := MerkleNode{0xde, 0xad}
+	err = rln.SetTombstone(tombstone)
+	s.NoError(err)
+
+	err = rln.DeleteMember(1)
+	s.NoError(err)
+
+	err = rln.DeleteMembers([]MembershipIndex{3})
+	s.NoError(err)
+
+	leaves, err := rln.LeafHashes()
+	s.NoError(err)
+	s.Equal([]MerkleNode{{}, tombstone, {0x03}, tombstone}, leaves)
+
+	for index, expected := range []bool{false, true, false, true} {
+		isTombstone, err := rln.IsTombstone(MembershipIndex(index))
+		s.NoError(err)
+		s.Equal(expected, isTombstone)
+	}
+
+	// the tombstone is stored along with the metadata, which is returned unchanged
+	err = rln.SetMetadata([]byte{0xaa})
+	s.NoError(err)
+
+	metadata, err := rln.GetMetadata()
+	s.NoError(err)
+	s.Equal([]byte{0xaa}, metadata)
+
+	// an instance loading the same tree restores the tombstone
+	reloaded := &RLN{w: rln.w, depth: rln.depth}
+	s.NoError(reloaded.loadTombstone())
+
+	isTombstone, err = reloaded.IsTombstone(1)
+	s.NoError(err)
+	s.True(isTombstone)
+
+	metadata, err = reloaded.GetMetadata()
+	s.NoError(err)
+	s.Equal([]byte{0xaa}, metadata)
+}
+
+func (s *RLNSuite) TestMatchEpochWindow() {
+	window := EpochWindow{EpochSize: 10, MaxEpochGap: 2}
+	now := time.Unix(10005, 0)
+	epoch := ToEpoch(CalcEpoch(now, window.EpochSize).Uint64() - 1)
+
+	rln, _, proof := s.newRLNWithProof([]byte("Hello"), epoch, 0)
+
+	matched, ok, err := rln.MatchEpochWindow(*proof, now, window)
+	s.NoError(err)
+	s.True(ok)
+	s.Equal(epoch, matched)
+
+	_, ok, err = rln.MatchEpochWindow(*proof, now.Add(time.Minute), window)
+	s.NoError(err)
+	s.False(ok)
+
+	// invalid windows are rejected before computing any epoch
+	_, _, err = rln.MatchEpochWindow(*proof, now, EpochWindow{})
+	s.Error(err)
+
+	_, _, err = rln.MatchEpochWindow(*proof, now, EpochWindow{EpochSize: 10, MaxEpochGap: math.MaxUint64})
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestCheckMembership() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	ok, err := rln.CheckMembership(1, *memKeys)
+	s.NoError(err)
+	s.True(ok)
+
+	ok, err = rln.CheckMembership(0, *memKeys)
+	s.NoError(err)
+	s.False(ok)
+
+	otherLimit := *memKeys
+	otherLimit.UserMessageLimit++
+	ok, err = rln.CheckMembership(1, otherLimit)
+	s.NoError(err)
+	s.False(ok)
+}
+
+func (s *RLNSuite) TestNewFromConfigJSON() {
+	configJSON := []byte(`{"resources_folder": "tree_height_20", "tree_config": {"path": "` + filepath.ToSlash(filepath.Join(s.T().TempDir(), "db")) + `"}}`)
+
+	rln, err := NewFromConfigJSON(int(DefaultTreeDepth), configJSON)
+	s.NoError(err)
+
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	expected := s.newRLN()
+	err = expected.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	root, err := rln.GetMerkleRoot()
+	s.NoError(err)
+	expectedRoot, err := expected.GetMerkleRoot()
+	s.NoError(err)
+	s.Equal(expectedRoot, root)
+}
+
+func (s *RLNSuite) TestInsertMembersWithRootCallback() {
+	rln := s.newRLN()
+
+	expected := s.newRLN()
+
+	members := make([]IDCommitmentWithLimit, 5)
+	for i := range members {
+		members[i] = IDCommitmentWithLimit{IDCommitment: IDCommitment{byte(i + 1)}, UserMessageLimit: uint32(i + 1)}
+	}
+
+	var processed []int
+	var roots []MerkleNode
+	err := rln.InsertMembersWithRootCallback(0, members, 2, func(n int, root MerkleNode) {
+		processed = append(processed, n)
+		roots = append(roots, root)
+	})
+	s.NoError(err)
+	s.Equal([]int{2, 4, 5}, processed)
+
+	for i, n := range processed {
+		start := 0
+		if i > 0 {
+			start = processed[i-1]
+		}
+		err := expected.InsertMembersWithLimits(MembershipIndex(start), members[start:n])
+		s.NoError(err)
+
+		root, err := expected.GetMerkleRoot()
+		s.NoError(err)
+		s.Equal(root, roots[i])
+	}
+
+	err = rln.InsertMembersWithRootCallback(0, members, 0, nil)
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestGenerateProofForMessage() {
+	rln := s.newRLN()
+
+	memKeys, err := rln.MembershipKeyGen()
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	// time.Time has a deterministic binary encoding
+	msg := time.Unix(1700000000, 0).UTC()
+	epoch := ToEpoch(1)
+
+	proof, err := rln.GenerateProofForMessage(msg, *memKeys, MembershipIndex(0), epoch, 0)
+	s.NoError(err)
+
+	verified, err := rln.VerifyMessage(msg, *proof)
+	s.NoError(err)
+	s.True(verified)
+
+	verified, err = rln.VerifyMessage(msg.Add(time.Second), *proof)
+	s.NoError(err)
+	s.False(verified)
+}
+
+func (s *RLNSuite) TestFlushWithRetry() {
+	rln, err := NewRLNWithOptions(DefaultTreeDepth, WithDBPath(filepath.Join(s.T().TempDir(), "db")))
+	s.NoError(err)
+
+	err = rln.InsertMember(IDCommitment{0x01}, 10)
+	s.NoError(err)
+
+	s.NoError(rln.FlushWithRetry(3, time.Millisecond))
+	s.Error(rln.FlushWithRetry(0, time.Millisecond))
+}
+
+func (s *RLNSuite) TestMaxUserMessageLimit() {
+	rln := s.newRLN()
+
+	limit := rln.MaxUserMessageLimit()
+
+	memKeys, err := rln.MembershipKeyGen(limit)
+	s.NoError(err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	s.NoError(err)
+
+	// the highest message id is still provable
+	proof, err := rln.GenerateProof([]byte("Hello"), *memKeys, MembershipIndex(0), ToEpoch(1), limit-1)
+	s.NoError(err)
+
+	verified, err := rln.Verify([]byte("Hello"), *proof)
+	s.NoError(err)
+	s.True(verified)
+
+	_, err = rln.MembershipKeyGen(limit + 1)
+	s.ErrorIs(err, ErrLimitTooLarge)
+
+	_, err = rln.SeededMembershipKeyGen([]byte("seed"), limit+1)
+	s.ErrorIs(err, ErrLimitTooLarge)
+
+	err = rln.InsertMember(IDCommitment{0x01}, limit+1)
+	s.ErrorIs(err, ErrLimitTooLarge)
+
+	err = rln.InsertMembersWithLimits(1, []IDCommitmentWithLimit{{IDCommitment: IDCommitment{0x01}, UserMessageLimit: limit + 1}})
+	s.ErrorIs(err, ErrLimitTooLarge)
+	s.Equal(uint(1), rln.LeavesSet())
+}
+
+func (s *RLNSuite) TestPartialRoot() {
+	rln := s.newRLN()
+
+	emptyRoot, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	root, err := PartialRoot(nil, DefaultTreeDepth, rln.Poseidon)
+	s.NoError(err)
+	s.Equal(emptyRoot, root)
+
+	leaves := map[MembershipIndex]MerkleNode{0: {0x01}, 3: {0x04}, 4: {0x05}, 100: {0x06}}
+	for index, leaf := range leaves {
+		err = rln.InsertMemberAt(index, leaf)
+		s.NoError(err)
+	}
+
+	expected, err := rln.GetMerkleRoot()
+	s.NoError(err)
+
+	root, err = PartialRoot(leaves, DefaultTreeDepth, rln.Poseidon)
+	s.NoError(err)
+	s.Equal(expected, root)
+
+	_, err = PartialRoot(map[MembershipIndex]MerkleNode{1 << 20: {0x01}}, DefaultTreeDepth, rln.Poseidon)
+	s.Error(err)
+}
+
+func (s *RLNSuite) TestPathBits() {
+	rln := s.newRLN()
+
+	for _, index := range []MembershipIndex{0, 1, 6, 1<<20 - 1} {
+		proof, err := rln.GetMerkleProof(index)
+		s.NoError(err)
+		s.Equal(proof.PathIndexes, PathBits(index, DefaultTreeDepth))
+	}
+
+	s.Equal([]uint8{0, 1, 1}, PathBits(6, 3))
+}
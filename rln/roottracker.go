@@ -0,0 +1,158 @@
+package rln
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RootTracker keeps the most recent roots of a Merkle tree, which are the roots
+// proofs are accepted for while members sync the latest changes of the tree. It
+// is safe for concurrent use
+type RootTracker struct {
+	mu    sync.RWMutex
+	size  int
+	roots []MerkleNode
+}
+
+// NewRootTracker creates a RootTracker that keeps up to `size` roots, which must be at least 1
+func NewRootTracker(size int) (*RootTracker, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid root tracker size: %d", size)
+	}
+
+	return &RootTracker{
+		size: size,
+	}, nil
+}
+
+// Add records a new root of the tree, evicting the oldest one if the tracker is
+// full. Adding the same root as the latest one has no effect
+func (t *RootTracker) Add(root MerkleNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.roots) != 0 && t.roots[len(t.roots)-1] == root {
+		return
+	}
+
+	t.roots = append(t.roots, root)
+	if len(t.roots) > t.size {
+		t.roots = t.roots[len(t.roots)-t.size:]
+	}
+}
+
+// Update records the current root of the tree of `r`
+func (t *RootTracker) Update(r *RLN) error {
+	root, err := r.GetMerkleRoot()
+	if err != nil {
+		return err
+	}
+	t.Add(root)
+	return nil
+}
+
+// Roots returns the roots being tracked, from the newest to the oldest
+func (t *RootTracker) Roots() [][32]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([][32]byte, len(t.roots))
+	for i, root := range t.roots {
+		result[len(t.roots)-1-i] = root
+	}
+	return result
+}
+
+// VerifyAgainstTracker verifies the proof like Verify, accepting only the roots being
+// tracked. Since Verify skips the root check when no roots are given, an empty
+// tracker is reported as an error
+func (r *RLN) VerifyAgainstTracker(data []byte, proof RateLimitProof, tracker *RootTracker) (bool, error) {
+	roots := tracker.Roots()
+	if len(roots) == 0 {
+		return false, errors.New("root tracker is empty")
+	}
+	return r.Verify(data, proof, roots...)
+}
+
+// RootHistory keeps the roots of a Merkle tree along with the time they became the
+// current root, in order, so the roots that were valid within a period of time can
+// be found with a binary search. It is safe for concurrent use
+type RootHistory struct {
+	mu      sync.RWMutex
+	entries []rootHistoryEntry
+}
+
+type rootHistoryEntry struct {
+	root MerkleNode
+	at   time.Time
+}
+
+// NewRootHistory creates an empty RootHistory
+func NewRootHistory() *RootHistory {
+	return &RootHistory{}
+}
+
+// Add records that `root` became the current root of the tree at the time `at`.
+// Roots must be added in chronological order
+func (h *RootHistory) Add(root MerkleNode, at time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) != 0 && at.Before(h.entries[len(h.entries)-1].at) {
+		return fmt.Errorf("root added at %s is older than the latest root", at)
+	}
+
+	h.entries = append(h.entries, rootHistoryEntry{root: root, at: at})
+	return nil
+}
+
+// Window returns the roots that were the current root at some point in the last
+// `maxAge` before `now`, from the newest to the oldest. It includes the root that was
+// current when the window started, even if it became current earlier
+func (h *RootHistory) Window(now time.Time, maxAge time.Duration) [][32]byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	start := now.Add(-maxAge)
+	end := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].at.After(now)
+	})
+	first := sort.Search(end, func(i int) bool {
+		return h.entries[i].at.After(start)
+	})
+	if first > 0 {
+		first--
+	}
+
+	result := make([][32]byte, 0, end-first)
+	for i := end - 1; i >= first; i-- {
+		result = append(result, h.entries[i].root)
+	}
+	return result
+}
+
+// Prune removes the roots that stopped being the current root before `before`
+func (h *RootHistory) Prune(before time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].at.After(before)
+	})
+	if n > 0 {
+		n--
+	}
+
+	h.entries = append([]rootHistoryEntry{}, h.entries[n:]...)
+}
+
+// Len returns the amount of roots recorded
+func (h *RootHistory) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.entries)
+}
@@ -0,0 +1,187 @@
+package rln
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SelfTestReport contains the time spent in each one of the phases of SelfTest
+type SelfTestReport struct {
+	KeyGen  time.Duration
+	Witness time.Duration
+	Proof   time.Duration
+	Verify  time.Duration
+}
+
+// Total returns the time spent in all the phases of SelfTest
+func (s SelfTestReport) Total() time.Duration {
+	return s.KeyGen + s.Witness + s.Proof + s.Verify
+}
+
+// SelfTest checks that the circuit artifacts used by this instance are present and
+// functional. It generates a membership, builds a witness for it as if it was the only
+// member of a tree with the same depth, and then generates and verifies a proof, timing
+// each phase. The Merkle tree of this instance is not modified
+func (r *RLN) SelfTest() (SelfTestReport, error) {
+	var report SelfTestReport
+
+	start := time.Now()
+	memKeys, err := r.MembershipKeyGen()
+	if err != nil {
+		return report, fmt.Errorf("self test key generation failed: %w", err)
+	}
+	report.KeyGen = time.Since(start)
+
+	data := []byte("rln self test")
+	epoch := ToEpoch(0)
+
+	start = time.Now()
+	witness, root, err := r.singleMemberWitness(*memKeys, data, epoch)
+	if err != nil {
+		return report, fmt.Errorf("self test witness generation failed: %w", err)
+	}
+	report.Witness = time.Since(start)
+
+	start = time.Now()
+	proof, err := r.GenerateRLNProofWithWitness(witness)
+	if err != nil {
+		return report, fmt.Errorf("self test proof generation failed: %w", err)
+	}
+	report.Proof = time.Since(start)
+
+	start = time.Now()
+	verified, err := r.Verify(data, *proof, root)
+	if err != nil {
+		return report, fmt.Errorf("self test proof verification failed: %w", err)
+	}
+	if !verified {
+		return report, errors.New("self test proof could not be verified")
+	}
+	report.Verify = time.Since(start)
+
+	return report, nil
+}
+
+// singleMemberWitness creates the witness for a membership placed at index 0 of an
+// otherwise empty tree with the same depth as this instance's tree, and returns it
+// along with the root of such tree
+func (r *RLN) singleMemberWitness(key IdentityCredential, data []byte, epoch Epoch) (RLNWitnessInput, MerkleNode, error) {
+	// the length of any Merkle proof matches the tree depth
+	currentProof, err := r.GetMerkleProof(0)
+	if err != nil {
+		return RLNWitnessInput{}, MerkleNode{}, err
+	}
+	depth := len(currentProof.PathElements)
+
+	node, err := r.hashLeaf(key.IDCommitment, key.UserMessageLimit)
+	if err != nil {
+		return RLNWitnessInput{}, MerkleNode{}, err
+	}
+
+	// all the siblings are empty subtrees, whose roots are obtained by
+	// hashing the zero leaf with itself once per level
+	var zeroNode MerkleNode
+	merkleProof := MerkleProof{
+		PathElements: make([]MerkleNode, depth),
+		PathIndexes:  make([]uint8, depth),
+	}
+	for i := 0; i < depth; i++ {
+		merkleProof.PathElements[i] = zeroNode
+
+		node, err = r.Poseidon(node[:], zeroNode[:])
+		if err != nil {
+			return RLNWitnessInput{}, MerkleNode{}, err
+		}
+
+		zeroNode, err = r.Poseidon(zeroNode[:], zeroNode[:])
+		if err != nil {
+			return RLNWitnessInput{}, MerkleNode{}, err
+		}
+	}
+
+	witness, err := r.CreateWitness(key.IDSecretHash, key.UserMessageLimit, 0, data, epoch, merkleProof)
+	if err != nil {
+		return RLNWitnessInput{}, MerkleNode{}, err
+	}
+
+	return witness, node, nil
+}
+
+// ThroughputReport contains the results of VerifyThroughput
+type ThroughputReport struct {
+	Samples     int
+	Parallelism int
+	// Elapsed is the time spent verifying all the samples
+	Elapsed time.Duration
+	// PerSecond is the amount of proofs verified per second
+	PerSecond float64
+}
+
+// VerifyThroughput measures how many proofs per second this instance can verify when
+// `parallelism` verifications are done concurrently. A sample proof is generated for a
+// membership of a tree with the same depth, as SelfTest does, and then it is verified
+// `samples` times with Verify. The Merkle tree of this instance is not modified
+func (r *RLN) VerifyThroughput(samples int, parallelism int) (ThroughputReport, error) {
+	if samples <= 0 || parallelism <= 0 {
+		return ThroughputReport{}, errors.New("samples and parallelism must be positive")
+	}
+
+	memKeys, err := r.MembershipKeyGen()
+	if err != nil {
+		return ThroughputReport{}, err
+	}
+
+	data := []byte("rln throughput test")
+	witness, root, err := r.singleMemberWitness(*memKeys, data, ToEpoch(0))
+	if err != nil {
+		return ThroughputReport{}, err
+	}
+
+	proof, err := r.GenerateRLNProofWithWitness(witness)
+	if err != nil {
+		return ThroughputReport{}, err
+	}
+
+	jobs := make(chan struct{}, samples)
+	for i := 0; i < samples; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	errs := make(chan error, parallelism)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				verified, err := r.Verify(data, *proof, root)
+				if err == nil && !verified {
+					err = errors.New("sample proof could not be verified")
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	close(errs)
+	if err := <-errs; err != nil {
+		return ThroughputReport{}, err
+	}
+
+	return ThroughputReport{
+		Samples:     samples,
+		Parallelism: parallelism,
+		Elapsed:     elapsed,
+		PerSecond:   float64(samples) / elapsed.Seconds(),
+	}, nil
+}
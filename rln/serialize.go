@@ -1,10 +1,13 @@
 package rln
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254"
 )
 
 // serialize converts a RateLimitProof and the data to a byte seq
@@ -21,7 +24,7 @@ func serialize(
 	memIndexBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(memIndexBytes, uint64(memIndex))
 
-	lenPrefMsg := appendLength(msg)
+	lenPrefMsg := LengthPrefix(msg)
 
 	var userMessageLimitByte [32]byte
 	var messageIdByte [32]byte
@@ -42,7 +45,7 @@ func serialize(
 // the order of serialization is based on https://github.com/kilic/rln/blob/7ac74183f8b69b399e3bc96c1ae8ab61c026dc43/src/public.rs#L205
 // [ proof<128> | root<32> | external_nullifier<32> | x<32> | y<32> | nullifier<32> | signal_len<8> | signal<var> ]
 func (r RateLimitProof) serializeWithData(data []byte) []byte {
-	lenPrefMsg := appendLength(data)
+	lenPrefMsg := LengthPrefix(data)
 	proofBytes := r.serialize()
 	proofBytes = append(proofBytes, lenPrefMsg...)
 	return proofBytes
@@ -59,6 +62,100 @@ func (r RateLimitProof) serialize() []byte {
 	return proofBytes
 }
 
+// rateLimitProofSize is the length of a serialized RateLimitProof
+const rateLimitProofSize = 128 + 32*5
+
+// deserialize parses a RateLimitProof serialized with serialize
+// [ proof<128> | root<32> | external_nullifier<32> | x<32> | y<32> | nullifier<32>]
+func (r *RateLimitProof) deserialize(b []byte) error {
+	if len(b) != rateLimitProofSize {
+		return fmt.Errorf("wrong input size expected: %d, current: %d", rateLimitProofSize, len(b))
+	}
+
+	proofOffset := 128
+	rootOffset := proofOffset + 32
+	externalNullifierOffset := rootOffset + 32
+	shareXOffset := externalNullifierOffset + 32
+	shareYOffset := shareXOffset + 32
+	nullifierOffset := shareYOffset + 32
+
+	copy(r.Proof[:], b[0:proofOffset])
+	copy(r.MerkleRoot[:], b[proofOffset:rootOffset])
+	copy(r.ExternalNullifier[:], b[rootOffset:externalNullifierOffset])
+	copy(r.ShareX[:], b[externalNullifierOffset:shareXOffset])
+	copy(r.ShareY[:], b[shareXOffset:shareYOffset])
+	copy(r.Nullifier[:], b[shareYOffset:nullifierOffset])
+
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder using the same layout
+// the proof has when it is passed to zerokit
+func (r RateLimitProof) GobEncode() ([]byte, error) {
+	return r.serialize(), nil
+}
+
+// GobDecode implements gob.GobDecoder
+func (r *RateLimitProof) GobDecode(b []byte) error {
+	return r.deserialize(b)
+}
+
+// Base64URL encodes the proof with the URL-safe base64 alphabet and no padding,
+// so it can be used as a query parameter
+func (r RateLimitProof) Base64URL() string {
+	return base64.RawURLEncoding.EncodeToString(r.serialize())
+}
+
+// ParseRateLimitProofBase64URL decodes a proof encoded with RateLimitProof.Base64URL
+func ParseRateLimitProofBase64URL(s string) (*RateLimitProof, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &RateLimitProof{}
+	if err := proof.deserialize(b); err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// SerializeProofBatch serializes multiple proofs with the following format
+// [ count<8> | proof_1<288> | ... | proof_count<288> ], the count being a 8 byte value
+// serialized in little endian, and each proof having the layout used by zerokit
+func SerializeProofBatch(proofs []RateLimitProof) []byte {
+	output := make([]byte, 8, 8+len(proofs)*rateLimitProofSize)
+	binary.LittleEndian.PutUint64(output, uint64(len(proofs)))
+	for _, proof := range proofs {
+		output = append(output, proof.serialize()...)
+	}
+	return output
+}
+
+// ParseProofBatch parses proofs serialized with SerializeProofBatch
+func ParseProofBatch(b []byte) ([]RateLimitProof, error) {
+	if len(b) < 8 {
+		return nil, errors.New(fmt.Sprintf("wrong input size expected at least: 8, current: %d", len(b)))
+	}
+
+	count := binary.LittleEndian.Uint64(b[:8])
+	b = b[8:]
+
+	if uint64(len(b))%rateLimitProofSize != 0 || uint64(len(b))/rateLimitProofSize != count {
+		return nil, errors.New(fmt.Sprintf("wrong input size for %d proofs: %d", count, len(b)))
+	}
+
+	proofs := make([]RateLimitProof, count)
+	for i := range proofs {
+		if err := proofs[i].deserialize(b[i*rateLimitProofSize : (i+1)*rateLimitProofSize]); err != nil {
+			return nil, err
+		}
+	}
+
+	return proofs, nil
+}
+
 // serialize converts a RLNWitnessInput to a byte seq
 // [ id_secret_hash<32> | user_message_limit<32> | message_id<32> | num_elements<8> | path_elements<var1> | num_indexes<8> | path_indexes<var2> | external_nullifier<32> ]
 func (r *RLNWitnessInput) serialize() []byte {
@@ -84,19 +181,36 @@ func (r *RLNWitnessInput) deserialize(b []byte) error {
 	return errors.New("not implemented")
 }
 
+// Bytes serializes the proof with the layout zerokit uses for the merkle proof
+// of a witness. Notice that the first length prefix is the number of path
+// elements and not their size in bytes:
+// [ num_elements<8> | path_elements<32 * num_elements> | num_indexes<8> | path_indexes<num_indexes> ]
+func (r MerkleProof) Bytes() []byte {
+	return r.serialize()
+}
+
+// ParseMerkleProof parses a proof serialized with MerkleProof.Bytes
+func ParseMerkleProof(b []byte) (*MerkleProof, error) {
+	proof := &MerkleProof{}
+	if err := proof.deserialize(b); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
 func (r *MerkleProof) serialize() []byte {
 	output := make([]byte, 0)
 
-	output = append(output, appendLength32(Flatten(r.PathElements))...)
-	output = append(output, appendLength(r.PathIndexes)...)
+	output = append(output, LengthPrefix32(Flatten(r.PathElements))...)
+	output = append(output, LengthPrefix(r.PathIndexes)...)
 
 	return output
 }
 
 func (r *MerkleProof) deserialize(b []byte) error {
 
-	// Check if we can read the first byte
-	if len(b) < 8 {
+	// Check if we can read both length prefixes
+	if len(b) < 16 {
 		return errors.New(fmt.Sprintf("wrong input size: %d", len(b)))
 	}
 
@@ -109,6 +223,12 @@ func (r *MerkleProof) deserialize(b []byte) error {
 	numElements.SetBytes(revert(b[offset : offset+8]))
 	offset += 8
 
+	// Each element takes 32 bytes plus 1 byte for its index. Checked before computing
+	// the expected length, which would overflow with a crafted amount of elements
+	if numElements.Uint64() > uint64(len(b)-16)/33 {
+		return errors.New(fmt.Sprintf("wrong input size for %s elements: %d", numElements.String(), len(b)))
+	}
+
 	// With numElements we can determine the expected length of the proof.
 	expectedLen := 8 + int(32*numElements.Uint64()) + 8 + int(numElements.Uint64())
 	if len(b) != expectedLen {
@@ -117,16 +237,10 @@ func (r *MerkleProof) deserialize(b []byte) error {
 			len(b)))
 	}
 
-	r.PathElements = make([]MerkleNode, numElements.Uint64())
-
-	for i := uint64(0); i < numElements.Uint64(); i++ {
-		copy(r.PathElements[i][:], b[offset:offset+32])
-		offset += 32
-	}
-
-	// Get amount of indexes in the path
-	numIndexes.SetBytes(revert(b[offset : offset+8]))
-	offset += 8
+	// Get amount of indexes in the path, stored after the elements
+	indexesOffset := offset + 32*int(numElements.Uint64())
+	numIndexes.SetBytes(revert(b[indexesOffset : indexesOffset+8]))
+	indexesOffset += 8
 
 	// Both numElements and numIndexes shall be equal and match the tree depth.
 	if numIndexes.Uint64() != numElements.Uint64() {
@@ -134,12 +248,24 @@ func (r *MerkleProof) deserialize(b []byte) error {
 			numElements.String(), numIndexes.String()))
 	}
 
-	r.PathIndexes = make([]uint8, numIndexes.Uint64())
+	// each index is the side of the path at that level, so it can only be 0 or 1.
+	// They are checked before allocating anything for the proof
+	for i, index := range b[indexesOffset:] {
+		if index > 1 {
+			return errors.New(fmt.Sprintf("invalid path index at level %d: %d", i, index))
+		}
+	}
+
+	r.PathElements = make([]MerkleNode, numElements.Uint64())
 
-	for i := uint64(0); i < numIndexes.Uint64(); i++ {
-		r.PathIndexes[i] = b[offset]
-		offset += 1
+	for i := uint64(0); i < numElements.Uint64(); i++ {
+		copy(r.PathElements[i][:], b[offset:offset+32])
+		offset += 32
 	}
+	offset += 8
+
+	r.PathIndexes = make([]uint8, numIndexes.Uint64())
+	offset += copy(r.PathIndexes, b[offset:])
 
 	if offset != len(b) {
 		return errors.New(
@@ -148,3 +274,77 @@ func (r *MerkleProof) deserialize(b []byte) error {
 
 	return nil
 }
+
+// arkworks flags, stored in the two most significant bits of a compressed point
+const (
+	arkYIsNegative     byte = 1 << 7
+	arkPointAtInfinity byte = 1 << 6
+	arkFlagsMask            = arkYIsNegative | arkPointAtInfinity
+)
+
+// gnark-crypto flags, stored in the two most significant bits of a compressed point
+const (
+	gnarkCompressedSmallest byte = 0b10 << 6
+	gnarkCompressedLargest  byte = 0b11 << 6
+	gnarkCompressedInfinity byte = 0b01 << 6
+)
+
+// arkToGnarkCompressed converts a point compressed by arkworks, made of one or two
+// little endian field elements with the flags in the last byte, into the format used
+// by gnark-crypto, made of the same field elements in big endian and in reverse order,
+// with the flags in the first byte
+func arkToGnarkCompressed(b []byte) []byte {
+	flags := b[len(b)-1] & arkFlagsMask
+
+	result := make([]byte, len(b))
+	copy(result, b)
+	result[len(b)-1] &^= arkFlagsMask
+	revert(result)
+
+	switch {
+	case flags&arkPointAtInfinity != 0:
+		result[0] |= gnarkCompressedInfinity
+	case flags&arkYIsNegative != 0:
+		// arkworks considers y negative when it is greater than -y
+		result[0] |= gnarkCompressedLargest
+	default:
+		result[0] |= gnarkCompressedSmallest
+	}
+
+	return result
+}
+
+// ABIEncode encodes the zkSNARK proof as the uint256[8] expected by the on-chain
+// Groth16 verifiers, i.e. [a.x, a.y, b.x.c1, b.x.c0, b.y.c1, b.y.c0, c.x, c.y], each
+// value as a 32 byte big endian word. The proof generated by zerokit contains the
+// points compressed, so they are decompressed first
+func (r RateLimitProof) ABIEncode() ([]byte, error) {
+	var a, c bn254.G1Affine
+	var b bn254.G2Affine
+
+	if _, err := a.SetBytes(arkToGnarkCompressed(r.Proof[0:32])); err != nil {
+		return nil, fmt.Errorf("invalid proof point a: %w", err)
+	}
+
+	if _, err := b.SetBytes(arkToGnarkCompressed(r.Proof[32:96])); err != nil {
+		return nil, fmt.Errorf("invalid proof point b: %w", err)
+	}
+
+	if _, err := c.SetBytes(arkToGnarkCompressed(r.Proof[96:128])); err != nil {
+		return nil, fmt.Errorf("invalid proof point c: %w", err)
+	}
+
+	words := [8][32]byte{
+		a.X.Bytes(), a.Y.Bytes(),
+		b.X.A1.Bytes(), b.X.A0.Bytes(),
+		b.Y.A1.Bytes(), b.Y.A0.Bytes(),
+		c.X.Bytes(), c.Y.Bytes(),
+	}
+
+	output := make([]byte, 0, 8*32)
+	for _, word := range words {
+		output = append(output, word[:]...)
+	}
+
+	return output, nil
+}
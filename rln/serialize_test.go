@@ -1,6 +1,12 @@
 package rln
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"math"
+	"math/big"
 	"math/rand"
 	"testing"
 
@@ -13,6 +19,20 @@ func random32() [32]byte {
 	return randomBytes
 }
 
+func randomRateLimitProof() RateLimitProof {
+	var zkproof ZKSNARK
+	_, _ = rand.Read(zkproof[:])
+
+	return RateLimitProof{
+		Proof:             zkproof,
+		MerkleRoot:        random32(),
+		ExternalNullifier: random32(),
+		ShareX:            random32(),
+		ShareY:            random32(),
+		Nullifier:         random32(),
+	}
+}
+
 func TestMerkleProofSerDe(t *testing.T) {
 
 	for _, testSize := range []int{0, 1, 8, 16, 20} {
@@ -38,6 +58,58 @@ func TestMerkleProofSerDe(t *testing.T) {
 	}
 }
 
+func TestNewMerkleProof(t *testing.T) {
+	elements := []MerkleNode{random32(), random32()}
+	indexes := []uint8{0, 1}
+
+	mProof, err := NewMerkleProof(elements, indexes)
+	require.NoError(t, err)
+	require.Equal(t, elements, mProof.PathElements)
+	require.Equal(t, indexes, mProof.PathIndexes)
+
+	_, err = NewMerkleProof(elements, []uint8{0})
+	require.Error(t, err)
+
+	_, err = NewMerkleProof(elements, []uint8{0, 5})
+	require.Error(t, err)
+}
+
+func TestMerkleProofInvalidPathIndex(t *testing.T) {
+	mProof := MerkleProof{
+		PathElements: []MerkleNode{random32(), random32()},
+		PathIndexes:  []uint8{1, 0},
+	}
+
+	ser := mProof.Bytes()
+	_, err := ParseMerkleProof(ser)
+	require.NoError(t, err)
+
+	// corrupt the last path index
+	ser[len(ser)-1] = 0x05
+	_, err = ParseMerkleProof(ser)
+	require.Error(t, err)
+
+	// the proof is rejected before modifying the receiver
+	parsed := MerkleProof{PathElements: []MerkleNode{{0x01}}, PathIndexes: []uint8{1}}
+	err = parsed.deserialize(ser)
+	require.Error(t, err)
+	require.Equal(t, MerkleProof{PathElements: []MerkleNode{{0x01}}, PathIndexes: []uint8{1}}, parsed)
+}
+
+func TestMerkleProofHugeNumElements(t *testing.T) {
+	// an amount of elements for which the expected length of the proof
+	// overflows to the 24 bytes of the input
+	ser := make([]byte, 24)
+	binary.LittleEndian.PutUint64(ser, 0x7c1f07c1f07c1f08)
+
+	_, err := ParseMerkleProof(ser)
+	require.Error(t, err)
+
+	binary.LittleEndian.PutUint64(ser, math.MaxUint64)
+	_, err = ParseMerkleProof(ser)
+	require.Error(t, err)
+}
+
 func TestRLNWitnessInputSerDe(t *testing.T) {
 	depth := 20
 
@@ -63,3 +135,128 @@ func TestRLNWitnessInputSerDe(t *testing.T) {
 	ser := witness.serialize()
 	require.Equal(t, 32+32+32+8+depth*32+depth+8+32+32, len(ser))
 }
+
+func TestRateLimitProofGob(t *testing.T) {
+	proof := randomRateLimitProof()
+
+	credential := IdentityCredential{
+		IDTrapdoor:       random32(),
+		IDNullifier:      random32(),
+		IDSecretHash:     random32(),
+		IDCommitment:     random32(),
+		UserMessageLimit: 20,
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(proof))
+	require.NoError(t, enc.Encode(credential))
+
+	var decodedProof RateLimitProof
+	var decodedCredential IdentityCredential
+	dec := gob.NewDecoder(&buf)
+	require.NoError(t, dec.Decode(&decodedProof))
+	require.NoError(t, dec.Decode(&decodedCredential))
+
+	require.Equal(t, proof, decodedProof)
+	require.True(t, IdentityCredentialEquals(credential, decodedCredential))
+
+	require.Error(t, decodedProof.GobDecode([]byte{0x01}))
+}
+
+func TestRateLimitProofBase64URL(t *testing.T) {
+	proof := randomRateLimitProof()
+
+	encoded := proof.Base64URL()
+	require.NotContains(t, encoded, "+")
+	require.NotContains(t, encoded, "/")
+	require.NotContains(t, encoded, "=")
+
+	decoded, err := ParseRateLimitProofBase64URL(encoded)
+	require.NoError(t, err)
+	require.Equal(t, proof, *decoded)
+
+	_, err = ParseRateLimitProofBase64URL("not base64!")
+	require.Error(t, err)
+
+	_, err = ParseRateLimitProofBase64URL(encoded[:20])
+	require.Error(t, err)
+}
+
+func TestProofBatch(t *testing.T) {
+	var proofs []RateLimitProof
+	for i := 0; i < 3; i++ {
+		proofs = append(proofs, randomRateLimitProof())
+	}
+
+	encoded := SerializeProofBatch(proofs)
+	require.Len(t, encoded, 8+3*rateLimitProofSize)
+
+	decoded, err := ParseProofBatch(encoded)
+	require.NoError(t, err)
+	require.Equal(t, proofs, decoded)
+
+	decoded, err = ParseProofBatch(SerializeProofBatch(nil))
+	require.NoError(t, err)
+	require.Empty(t, decoded)
+
+	_, err = ParseProofBatch(encoded[:len(encoded)-1])
+	require.Error(t, err)
+
+	_, err = ParseProofBatch(encoded[:4])
+	require.Error(t, err)
+}
+
+func TestMerkleProofToBigEndian(t *testing.T) {
+	mProof := MerkleProof{
+		PathElements: []MerkleNode{random32(), random32()},
+		PathIndexes:  []uint8{1, 0},
+	}
+	original := mProof.PathElements[0]
+
+	beProof := mProof.ToBigEndian()
+	require.Equal(t, mProof.PathIndexes, beProof.PathIndexes)
+	for i := range mProof.PathElements {
+		require.Equal(t, Bytes32ToBigInt(mProof.PathElements[i]).Bytes(), new(big.Int).SetBytes(beProof.PathElements[i][:]).Bytes())
+	}
+
+	// the original proof is not modified
+	require.Equal(t, original, mProof.PathElements[0])
+	require.Equal(t, mProof, beProof.ToBigEndian())
+}
+
+func TestABIEncodeKnownVector(t *testing.T) {
+	// a = 2*G1, b = G2 and c = -G1 of bn254, compressed by arkworks
+	compressed, err := hex.DecodeString("" +
+		"d3cf876dc108c2d3a81c8716a91678d9851518685b04859b021a132ee7440603" +
+		"edf692d95cbdde46ddda5ef7d422436779445c5e66006a42761e1f12efde0018" +
+		"c212f3aeb785e49712e7a9353349aaf1255dfb31b7bf60723a480d9293938e19" +
+		"0100000000000000000000000000000000000000000000000000000000000080")
+	require.NoError(t, err)
+
+	var proof RateLimitProof
+	copy(proof.Proof[:], compressed)
+
+	encoded, err := proof.ABIEncode()
+	require.NoError(t, err)
+
+	expected := []string{
+		// a.x, a.y
+		"030644e72e131a029b85045b68181585d97816a916871ca8d3c208c16d87cfd3",
+		"15ed738c0e0a7c92e7845f96b2ae9c0a68a6a449e3538fc7ff3ebf7a5a18a2c4",
+		// b.x.c1, b.x.c0
+		"198e9393920d483a7260bfb731fb5d25f1aa493335a9e71297e485b7aef312c2",
+		"1800deef121f1e76426a00665e5c4479674322d4f75edadd46debd5cd992f6ed",
+		// b.y.c1, b.y.c0
+		"090689d0585ff075ec9e99ad690c3395bc4b313370b38ef355acdadcd122975b",
+		"12c85ea5db8c6deb4aab71808dcb408fe3d1e7690c43d37b4ce6cc0166fa7daa",
+		// c.x, c.y
+		"0000000000000000000000000000000000000000000000000000000000000001",
+		"30644e72e131a029b85045b68181585d97816a916871ca8d3c208c16d87cfd45",
+	}
+
+	require.Len(t, encoded, 8*32)
+	for i, word := range expected {
+		require.Equal(t, word, hex.EncodeToString(encoded[32*i:32*(i+1)]), "word %d", i)
+	}
+}
@@ -0,0 +1,104 @@
+package rln
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SlashingEvidence contains the two conflicting shares published by a member with
+// the same nullifier, and the secret that was recovered out of them
+type SlashingEvidence struct {
+	Nullifier Nullifier
+	// each share is represented as [x, y]
+	Share1 [2]MerkleNode
+	Share2 [2]MerkleNode
+	Secret IDSecretHash
+}
+
+// slashingEvidenceSize is the length of an encoded SlashingEvidence
+const slashingEvidenceSize = 32 * 6
+
+// Encode serializes the evidence as
+// [ nullifier<32> | share1_x<32> | share1_y<32> | share2_x<32> | share2_y<32> | secret<32> ]
+func (e SlashingEvidence) Encode() []byte {
+	output := make([]byte, 0, slashingEvidenceSize)
+	output = append(output, e.Nullifier[:]...)
+	output = append(output, e.Share1[0][:]...)
+	output = append(output, e.Share1[1][:]...)
+	output = append(output, e.Share2[0][:]...)
+	output = append(output, e.Share2[1][:]...)
+	output = append(output, e.Secret[:]...)
+	return output
+}
+
+// Decode parses an evidence serialized with Encode
+func (e *SlashingEvidence) Decode(b []byte) error {
+	if len(b) != slashingEvidenceSize {
+		return fmt.Errorf("wrong input size expected: %d, current: %d", slashingEvidenceSize, len(b))
+	}
+
+	copy(e.Nullifier[:], b[0:32])
+	copy(e.Share1[0][:], b[32:64])
+	copy(e.Share1[1][:], b[64:96])
+	copy(e.Share2[0][:], b[96:128])
+	copy(e.Share2[1][:], b[128:160])
+	copy(e.Secret[:], b[160:192])
+
+	return nil
+}
+
+// RecoverSlashingEvidence recovers the secret of a member that published two proofs
+// with the same nullifier but different shares, and returns it along with the
+// conflicting shares, ready to be submitted
+func (r *RLN) RecoverSlashingEvidence(proof1 RateLimitProof, proof2 RateLimitProof) (*SlashingEvidence, error) {
+	if proof1.Nullifier != proof2.Nullifier {
+		return nil, errors.New("proofs have different nullifiers")
+	}
+
+	if proof1.ShareX == proof2.ShareX && proof1.ShareY == proof2.ShareY {
+		return nil, errors.New("proofs have the same shares")
+	}
+
+	secret, err := r.RecoverIDSecret(proof1, proof2)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SlashingEvidence{
+		Nullifier: proof1.Nullifier,
+		Share1:    [2]MerkleNode{proof1.ShareX, proof1.ShareY},
+		Share2:    [2]MerkleNode{proof2.ShareX, proof2.ShareY},
+		Secret:    secret,
+	}, nil
+}
+
+// FindDoubleSignals groups the proofs by nullifier, and returns the groups of proofs
+// whose nullifier was used with different shares, meaning the member sent more messages
+// than allowed in an epoch. Proofs with the same shares as a previous one in the group
+// are duplicates of the same message, and are not included
+func FindDoubleSignals(proofs []RateLimitProof) map[Nullifier][]RateLimitProof {
+	groups := make(map[Nullifier][]RateLimitProof)
+	for _, proof := range proofs {
+		group := groups[proof.Nullifier]
+
+		duplicate := false
+		for _, p := range group {
+			if p.ShareX == proof.ShareX && p.ShareY == proof.ShareY {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			groups[proof.Nullifier] = append(group, proof)
+		}
+	}
+
+	result := make(map[Nullifier][]RateLimitProof)
+	for nullifier, group := range groups {
+		if len(group) > 1 {
+			result[nullifier] = group
+		}
+	}
+	return result
+}
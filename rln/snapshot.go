@@ -0,0 +1,297 @@
+package rln
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// SnapshotFormat is the encoding used for the body of a snapshot
+type SnapshotFormat byte
+
+const (
+	// SnapshotBinary is a compact binary encoding
+	SnapshotBinary SnapshotFormat = iota
+	// SnapshotJSON is a human readable encoding, useful for debugging
+	SnapshotJSON
+)
+
+func (f SnapshotFormat) String() string {
+	switch f {
+	case SnapshotBinary:
+		return "binary"
+	case SnapshotJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("SnapshotFormat(%d)", byte(f))
+	}
+}
+
+// snapshotMagic identifies the start of a snapshot
+var snapshotMagic = []byte("RLNS")
+
+const snapshotVersion = 1
+
+// snapshotHeaderSize is the size of the header of a snapshot, with the following format
+// [ magic<4> | version<1> | format<1> ]
+const snapshotHeaderSize = 6
+
+// treeSnapshot contains the state of the Merkle tree stored in a snapshot
+type treeSnapshot struct {
+	depth    TreeDepth
+	root     MerkleNode
+	metadata []byte
+	leaves   []MerkleNode
+}
+
+// jsonSnapshot is the body of a snapshot in the SnapshotJSON format
+type jsonSnapshot struct {
+	Depth    TreeDepth `json:"depth"`
+	Root     string    `json:"root"`
+	Metadata string    `json:"metadata"`
+	Leaves   []string  `json:"leaves"`
+}
+
+// Snapshot exports the leaves, root and metadata of the Merkle tree in the given
+// format. The format is stored in the header of the snapshot
+func (r *RLN) Snapshot(format SnapshotFormat) ([]byte, error) {
+	leaves, err := r.LeafHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := r.GetMerkleRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	s := treeSnapshot{
+		depth:    r.depth,
+		root:     root,
+		metadata: metadata,
+		leaves:   leaves,
+	}
+
+	output := append([]byte{}, snapshotMagic...)
+	output = append(output, snapshotVersion, byte(format))
+
+	switch format {
+	case SnapshotBinary:
+		return append(output, s.marshalBinary()...), nil
+	case SnapshotJSON:
+		body, err := s.marshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		return append(output, body...), nil
+	default:
+		return nil, fmt.Errorf("unsupported snapshot format: %s", format)
+	}
+}
+
+// RestoreSnapshot replaces the leaves and metadata of the Merkle tree with the ones
+// in the snapshot, which must have been exported in the given format from a tree of
+// the same depth. The root of the tree is checked against the one in the snapshot
+// once restored. LeavesSet is not decreased if the tree had more leaves
+func (r *RLN) RestoreSnapshot(data []byte, format SnapshotFormat) error {
+	if len(data) < snapshotHeaderSize || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return ErrInvalidSnapshot
+	}
+
+	if data[4] != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, data[4])
+	}
+
+	if SnapshotFormat(data[5]) != format {
+		return fmt.Errorf("%w: expected format %s, got %s", ErrInvalidSnapshot, format, SnapshotFormat(data[5]))
+	}
+
+	var s treeSnapshot
+	var err error
+	switch format {
+	case SnapshotBinary:
+		err = s.unmarshalBinary(data[snapshotHeaderSize:])
+	case SnapshotJSON:
+		err = s.unmarshalJSON(data[snapshotHeaderSize:])
+	default:
+		return fmt.Errorf("unsupported snapshot format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.depth != r.depth {
+		return fmt.Errorf("snapshot depth %d does not match tree depth %d", s.depth, r.depth)
+	}
+
+	numLeaves, err := r.LeavesSetChecked()
+	if err != nil {
+		return err
+	}
+
+	// leaves above the ones in the snapshot are zeroed
+	leaves := s.leaves
+	if numLeaves > uint(len(leaves)) {
+		leaves = make([]MerkleNode, numLeaves)
+		copy(leaves, s.leaves)
+	}
+
+	if len(leaves) != 0 {
+		if err := r.AtomicOperation(0, leaves, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := r.SetMetadata(s.metadata); err != nil {
+		return err
+	}
+
+	return r.AssertRoot(s.root)
+}
+
+// marshalBinary serializes the snapshot with the following format
+// [ depth<1> | root<32> | metadata_len<8> | metadata<var> | leaves_len<8> | leaves<var> ]
+func (s treeSnapshot) marshalBinary() []byte {
+	output := []byte{byte(s.depth)}
+	output = append(output, s.root[:]...)
+	output = append(output, LengthPrefix(s.metadata)...)
+	output = append(output, LengthPrefix32(Flatten(s.leaves))...)
+	return output
+}
+
+func (s *treeSnapshot) unmarshalBinary(b []byte) error {
+	if len(b) < 1+32+8 {
+		return fmt.Errorf("%w: truncated body", ErrInvalidSnapshot)
+	}
+
+	s.depth = TreeDepth(b[0])
+	copy(s.root[:], b[1:33])
+	b = b[33:]
+
+	metadataLen := binary.LittleEndian.Uint64(b[:8])
+	b = b[8:]
+	if len(b) < 8 || metadataLen > uint64(len(b)-8) {
+		return fmt.Errorf("%w: truncated metadata", ErrInvalidSnapshot)
+	}
+	s.metadata = append([]byte{}, b[:metadataLen]...)
+	b = b[metadataLen:]
+
+	numLeaves := binary.LittleEndian.Uint64(b[:8])
+	b = b[8:]
+	if uint64(len(b))%32 != 0 || uint64(len(b))/32 != numLeaves {
+		return fmt.Errorf("%w: expected %d leaves, got %d bytes", ErrInvalidSnapshot, numLeaves, len(b))
+	}
+
+	s.leaves = make([]MerkleNode, numLeaves)
+	for i := range s.leaves {
+		copy(s.leaves[i][:], b[i*32:(i+1)*32])
+	}
+
+	return nil
+}
+
+func (s treeSnapshot) marshalJSON() ([]byte, error) {
+	body := jsonSnapshot{
+		Depth:    s.depth,
+		Root:     hex.EncodeToString(s.root[:]),
+		Metadata: hex.EncodeToString(s.metadata),
+		Leaves:   make([]string, len(s.leaves)),
+	}
+	for i, leaf := range s.leaves {
+		body.Leaves[i] = hex.EncodeToString(leaf[:])
+	}
+	return json.Marshal(body)
+}
+
+func (s *treeSnapshot) unmarshalJSON(b []byte) error {
+	var body jsonSnapshot
+	if err := json.Unmarshal(b, &body); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	root, err := decodeHex32(body.Root)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := hex.DecodeString(body.Metadata)
+	if err != nil {
+		return fmt.Errorf("%w: invalid metadata: %v", ErrInvalidSnapshot, err)
+	}
+
+	leaves := make([]MerkleNode, len(body.Leaves))
+	for i, leaf := range body.Leaves {
+		leaves[i], err = decodeHex32(leaf)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.depth = body.Depth
+	s.root = root
+	s.metadata = metadata
+	s.leaves = leaves
+
+	return nil
+}
+
+func decodeHex32(s string) ([32]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if len(b) != 32 {
+		return [32]byte{}, fmt.Errorf("%w: expected 32 bytes, got %d", ErrInvalidSnapshot, len(b))
+	}
+	return Bytes32(b), nil
+}
+
+// SignedSnapshot exports the tree like Snapshot in the SnapshotBinary format, followed
+// by the ed25519 signature of the snapshot with `priv`, so it can be distributed by a
+// trusted party
+func (r *RLN) SignedSnapshot(priv ed25519.PrivateKey) ([]byte, error) {
+	snapshot, err := r.Snapshot(SnapshotBinary)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := ed25519.Sign(priv, snapshot)
+	return append(snapshot, signature...), nil
+}
+
+// VerifySignedSnapshot checks that the snapshot was signed with the private key of `pub`
+// and, only if so, creates a RLN instance with a tree of the depth of the snapshot, using
+// the circuit artifacts embedded in zerokit, and restores the snapshot into it
+func VerifySignedSnapshot(blob []byte, pub ed25519.PublicKey) (*RLN, error) {
+	if len(blob) < snapshotHeaderSize+1+ed25519.SignatureSize {
+		return nil, ErrInvalidSnapshot
+	}
+
+	snapshot := blob[:len(blob)-ed25519.SignatureSize]
+	signature := blob[len(blob)-ed25519.SignatureSize:]
+	if !ed25519.Verify(pub, snapshot, signature) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidSnapshot)
+	}
+
+	// the depth is the first value of the body of a binary snapshot
+	depth := TreeDepth(snapshot[snapshotHeaderSize])
+
+	r, err := NewWithConfig(depth, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.RestoreSnapshot(snapshot, SnapshotBinary); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
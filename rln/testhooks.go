@@ -0,0 +1,11 @@
+//go:build rln_testhooks
+// +build rln_testhooks
+
+package rln
+
+// SetRLNIdentifier replaces the RLN identifier used by this instance to construct
+// external nullifiers. This is only meant to reproduce test vectors from other
+// implementations, and is available only when building with the `rln_testhooks` tag
+func (r *RLN) SetRLNIdentifier(identifier RLNIdentifier) {
+	r.identifier = &identifier
+}
@@ -0,0 +1,42 @@
+//go:build rln_testhooks
+// +build rln_testhooks
+
+package rln
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetRLNIdentifier(t *testing.T) {
+	rln, err := NewRLN()
+	require.NoError(t, err)
+
+	memKeys, err := rln.MembershipKeyGen()
+	require.NoError(t, err)
+
+	err = rln.InsertMember(memKeys.IDCommitment, memKeys.UserMessageLimit)
+	require.NoError(t, err)
+
+	msg := []byte("Hello")
+	epoch := ToEpoch(1000)
+
+	proof1, err := rln.GenerateProof(msg, *memKeys, MembershipIndex(0), epoch, 0)
+	require.NoError(t, err)
+
+	rln.SetRLNIdentifier(RLNIdentifier{})
+
+	proof2, err := rln.GenerateProof(msg, *memKeys, MembershipIndex(0), epoch, 0)
+	require.NoError(t, err)
+
+	zeroIdentifier := RLNIdentifier{}
+	expectedExternalNullifier, err := rln.Poseidon(epoch[:], zeroIdentifier[:])
+	require.NoError(t, err)
+	require.Equal(t, expectedExternalNullifier, proof2.ExternalNullifier)
+	require.NotEqual(t, proof1.ExternalNullifier, proof2.ExternalNullifier)
+
+	verified, err := rln.Verify(msg, *proof2)
+	require.NoError(t, err)
+	require.True(t, verified)
+}
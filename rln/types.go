@@ -2,8 +2,12 @@ package rln
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -48,6 +52,12 @@ func IdentityCredentialEquals(i IdentityCredential, i2 IdentityCredential) bool
 		i.UserMessageLimit == i2.UserMessageLimit
 }
 
+// IDSecretHashEquals compares two secrets in constant time. IDSecretHash is an
+// alias of [32]byte, so this is a function instead of an Equal method
+func IDSecretHashEquals(s IDSecretHash, s2 IDSecretHash) bool {
+	return subtle.ConstantTimeCompare(s[:], s2[:]) == 1
+}
+
 // Equivalent plus proof: https://github.com/vacp2p/zerokit/blob/v0.5.0/rln/src/protocol.rs#L52
 type RateLimitProof struct {
 	// RateLimitProof holds the public inputs to rln circuit as
@@ -68,11 +78,114 @@ type RateLimitProof struct {
 	Nullifier Nullifier `json:"nullifier"`
 }
 
+// Validate checks that the proof is well formed: every public input must be a
+// valid field element, and neither the zkSNARK proof, the Merkle root nor the
+// nullifier can be empty. Empty values are reported with ErrDegenerateProof
+func (p RateLimitProof) Validate() error {
+	if p.Proof == (ZKSNARK{}) {
+		return fmt.Errorf("%w: zkSNARK proof is empty", ErrDegenerateProof)
+	}
+
+	if p.MerkleRoot == (MerkleNode{}) {
+		return fmt.Errorf("%w: merkle root is empty", ErrDegenerateProof)
+	}
+
+	if p.Nullifier == (Nullifier{}) {
+		return fmt.Errorf("%w: nullifier is empty", ErrDegenerateProof)
+	}
+
+	fields := []struct {
+		name  string
+		value [32]byte
+	}{
+		{"merkle root", p.MerkleRoot},
+		{"external nullifier", p.ExternalNullifier},
+		{"share x", p.ShareX},
+		{"share y", p.ShareY},
+		{"nullifier", p.Nullifier},
+	}
+	for _, f := range fields {
+		if !isFieldElement(f.value) {
+			return fmt.Errorf("invalid proof: %s is not a valid field element", f.name)
+		}
+	}
+
+	return nil
+}
+
+// ProofsAgree checks whether two proofs have the same public inputs and outputs, i.e.
+// the same merkle root, external nullifier, shares and nullifier. This is what must
+// match between proofs generated for the same message with GenerateProof and with
+// GenerateRLNProofWithWitness. The zkSNARK proof itself is not compared, since it is
+// randomized and differs between two proofs of the same statement
+func ProofsAgree(a, b RateLimitProof) bool {
+	return a.MerkleRoot == b.MerkleRoot &&
+		a.ExternalNullifier == b.ExternalNullifier &&
+		a.ShareX == b.ShareX &&
+		a.ShareY == b.ShareY &&
+		a.Nullifier == b.Nullifier
+}
+
+// VerifyItem is a proof to be verified along with its data
+type VerifyItem struct {
+	Data  []byte
+	Proof RateLimitProof
+}
+
+// VerifyItemWithRoots is a proof to be verified along with its data and the roots
+// that are acceptable for it
+type VerifyItemWithRoots struct {
+	Data  []byte
+	Proof RateLimitProof
+	Roots [][32]byte
+}
+
 type MerkleProof struct {
 	PathElements []MerkleNode `json:"pathElements"`
 	PathIndexes  []uint8      `json:"pathIndexes"`
 }
 
+// NewMerkleProof creates a MerkleProof from a path obtained elsewhere. Both
+// elements and indexes shall have the same length, matching the tree depth,
+// and every index must be 0 or 1
+func NewMerkleProof(elements []MerkleNode, indexes []uint8) (MerkleProof, error) {
+	if len(elements) != len(indexes) {
+		return MerkleProof{}, fmt.Errorf("amount of values in path and indexes do not match: %d vs %d",
+			len(elements), len(indexes))
+	}
+
+	for i, index := range indexes {
+		if index > 1 {
+			return MerkleProof{}, fmt.Errorf("invalid path index at level %d: %d", i, index)
+		}
+	}
+
+	return MerkleProof{
+		PathElements: elements,
+		PathIndexes:  indexes,
+	}, nil
+}
+
+// ToBigEndian returns a copy of the proof with each path element converted from
+// the little-endian representation used by zerokit to big-endian. Path indexes
+// are bits of the leaf index ordered from the leaf to the root, which do not
+// depend on endianness, so they are copied as they are
+func (m MerkleProof) ToBigEndian() MerkleProof {
+	elements := make([]MerkleNode, len(m.PathElements))
+	for i, e := range m.PathElements {
+		elements[i] = e
+		revert(elements[i][:])
+	}
+
+	indexes := make([]uint8, len(m.PathIndexes))
+	copy(indexes, m.PathIndexes)
+
+	return MerkleProof{
+		PathElements: elements,
+		PathIndexes:  indexes,
+	}
+}
+
 // Equivalent: https://github.com/vacp2p/zerokit/blob/v0.5.0/rln/src/protocol.rs#L35
 type RLNWitnessInput struct {
 	IDSecretHash      IDSecretHash `json:"identitySecretHash"`
@@ -93,6 +206,27 @@ const (
 
 const DefaultTreeDepth = TreeDepth20
 
+// ParseTreeDepth converts a string such as "20" or "TreeDepth20" into a TreeDepth.
+// ErrUnsupportedDepth is returned if the value is not one of the supported depths
+func ParseTreeDepth(s string) (TreeDepth, error) {
+	value := strings.TrimSpace(s)
+	if len(value) > len("TreeDepth") && strings.EqualFold(value[:len("TreeDepth")], "TreeDepth") {
+		value = value[len("TreeDepth"):]
+	}
+
+	depth, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedDepth, s)
+	}
+
+	switch TreeDepth(depth) {
+	case TreeDepth15, TreeDepth19, TreeDepth20:
+		return TreeDepth(depth), nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedDepth, s)
+	}
+}
+
 type TreeMode string
 
 const (
@@ -105,26 +239,75 @@ type TreeConfig struct {
 	Mode          TreeMode
 	Compression   bool
 	FlushInterval time.Duration
-	Path          string
+	// Path is the directory of the db backing the Merkle tree. When set, it is
+	// created if needed and must be writable
+	Path string
+	// ResourcesPath is the base directory containing the `tree_height_N` folders with
+	// the circuit artifacts. When empty, the artifacts embedded in zerokit are used.
+	// It is not part of the tree config sent to zerokit
+	ResourcesPath string
+	// SignalHasher, when set, is applied to the data of every message before
+	// generating or verifying its proof. It is not part of the tree config sent to zerokit
+	SignalHasher SignalHasher
+
+	// temporary makes zerokit keep the tree in a temporary db at a path of its choice,
+	// like it does when no tree config is given. Path must be empty
+	temporary bool
 }
 
+// SignalHasher transforms the data of a message into the signal passed to zerokit,
+// which maps it to a field element. It allows matching the signal reduction done
+// by other RLN implementations
+type SignalHasher func(data []byte) []byte
+
 func (t TreeConfig) MarshalJSON() ([]byte, error) {
 	output := struct {
 		CacheCapacity int      `json:"cache_capacity"`
 		Mode          TreeMode `json:"mode"`
 		Compression   bool     `json:"compression"`
 		FlushInterval uint     `json:"flush_every_ms"`
-		Path          string   `json:"path"`
+		Path          *string  `json:"path"`
+		Temporary     bool     `json:"temporary,omitempty"`
 	}{
 		CacheCapacity: t.CacheCapacity,
 		Mode:          t.Mode,
 		Compression:   t.Compression,
 		FlushInterval: uint(t.FlushInterval) / uint(time.Millisecond),
-		Path:          t.Path,
+		Temporary:     t.temporary,
+	}
+
+	// a null path lets zerokit choose the one of the temporary db
+	if !t.temporary {
+		output.Path = &t.Path
 	}
+
 	return json.Marshal(output)
 }
 
+// TreeOption modifies the TreeConfig used by NewRLNWithOptions
+type TreeOption func(*TreeConfig)
+
+// WithCacheCapacity sets the cache capacity of the db backing the Merkle tree
+func WithCacheCapacity(n int) TreeOption {
+	return func(t *TreeConfig) {
+		t.CacheCapacity = n
+	}
+}
+
+// WithDBPath sets the directory of the db backing the Merkle tree
+func WithDBPath(path string) TreeOption {
+	return func(t *TreeConfig) {
+		t.Path = path
+	}
+}
+
+// WithSignalHasher sets the SignalHasher applied to the data of every message
+func WithSignalHasher(h SignalHasher) TreeOption {
+	return func(t *TreeConfig) {
+		t.SignalHasher = h
+	}
+}
+
 type config struct {
 	ResourcesFolder string      `json:"resources_folder"`
 	TreeConfig      *TreeConfig `json:"tree_config,omitempty"`
@@ -132,6 +315,13 @@ type config struct {
 
 type MembershipIndex = uint
 
+// IDCommitmentWithLimit identifies a membership by its id commitment and
+// the user message limit that was used to calculate its leaf
+type IDCommitmentWithLimit struct {
+	IDCommitment     IDCommitment
+	UserMessageLimit uint32
+}
+
 type ProofMetadata struct {
 	Nullifier         Nullifier
 	ShareX            MerkleNode
@@ -192,6 +382,19 @@ func (e Epoch) Uint64() uint64 {
 	return binary.LittleEndian.Uint64(e[:])
 }
 
+// ToEpochBE is like ToEpoch, but encodes the value as a big-endian 256-bit integer,
+// i.e. in the last 8 bytes of the epoch
+func ToEpochBE(t uint64) Epoch {
+	var result Epoch
+	binary.BigEndian.PutUint64(result[24:], t)
+	return result
+}
+
+// Uint64BE decodes an epoch created with ToEpochBE
+func (e Epoch) Uint64BE() uint64 {
+	return binary.BigEndian.Uint64(e[24:])
+}
+
 // CalcEpoch returns the corresponding rln `Epoch` value for a time.Time
 func CalcEpoch(t time.Time, epochSize uint64) Epoch {
 	return ToEpoch(uint64(t.Unix()) / epochSize)
@@ -209,6 +412,30 @@ func Diff(e1, e2 Epoch) int64 {
 	return int64(epoch1) - int64(epoch2)
 }
 
+// NextEpochBoundary returns the instant the epoch containing `now` ends, for epochs
+// of length `resolution`. With a resolution of whole seconds, the returned time is
+// the start of the epoch following CalcEpoch(now, resolution seconds). There are no
+// epochs for a resolution that is not positive, so `now` is returned unchanged
+func NextEpochBoundary(now time.Time, resolution time.Duration) time.Time {
+	r := resolution.Nanoseconds()
+	if r <= 0 {
+		return now
+	}
+
+	// floor division, so instants before the unix epoch are rounded down too
+	current := now.UnixNano() / r
+	if now.UnixNano()%r < 0 {
+		current--
+	}
+	return time.Unix(0, (current+1)*r)
+}
+
 func (e Epoch) Time(epochSize uint64) time.Time {
 	return time.Unix(int64(e.Uint64()*epochSize), 0)
 }
+
+// Format renders the start of the epoch, for epochs of length `resolution`, in UTC
+// using the given time layout, e.g. time.RFC3339. `resolution` is truncated to seconds
+func (e Epoch) Format(resolution time.Duration, layout string) string {
+	return e.Time(uint64(resolution / time.Second)).UTC().Format(layout)
+}
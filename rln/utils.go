@@ -50,6 +50,24 @@ func ToIdentityCredentials(groupKeys [][]string) ([]IdentityCredential, error) {
 	return groupIdCredentials, nil
 }
 
+// FromIdentityCredentials is the inverse of ToIdentityCredentials. It serializes the
+// credentials into tuples of (id trapdoor, id nullifier, id secret hash, id commitment)
+// in hexadecimal format
+func FromIdentityCredentials(creds []IdentityCredential) [][]string {
+	var groupKeys [][]string
+
+	for _, c := range creds {
+		groupKeys = append(groupKeys, []string{
+			FromBytes32LE(c.IDTrapdoor),
+			FromBytes32LE(c.IDNullifier),
+			FromBytes32LE(c.IDSecretHash),
+			FromBytes32LE(c.IDCommitment),
+		})
+	}
+
+	return groupKeys
+}
+
 func Bytes32(b []byte) [32]byte {
 	var result [32]byte
 	copy(result[32-len(b):], b)
@@ -85,6 +103,11 @@ func ToBytes32LE(hexStr string) ([32]byte, error) {
 	return Bytes32(b), nil
 }
 
+// FromBytes32LE is the inverse of ToBytes32LE
+func FromBytes32LE(value [32]byte) string {
+	return hex.EncodeToString(revert(value[:]))
+}
+
 func revert(b []byte) []byte {
 	bLen := len(b)
 	for i := 0; i < bLen/2; i++ {
@@ -168,9 +191,26 @@ func HashToBN255(data []byte) [32]byte {
 	return fixexLen
 }
 
+// isFieldElement checks if a little endian 32 byte value is lower than the BN254 scalar field modulus
+func isFieldElement(value [32]byte) bool {
+	return Bytes32ToBigInt(value).Cmp(fr.Modulus()) < 0
+}
+
 func SerializeUint32(input uint32) [32]byte {
 	var byte32Type [32]byte
 	binary.LittleEndian.PutUint32(byte32Type[0:], input)
 
 	return byte32Type
 }
+
+// ValidMessageIDRange returns the range of message ids a member with the user message
+// limit can use in an epoch. The maximum is exclusive: the limit itself is not a valid id
+func ValidMessageIDRange(limit uint32) (min, maxExclusive uint32) {
+	return 0, limit
+}
+
+// IsValidMessageID checks whether a member with the user message limit can use the message id
+func IsValidMessageID(id, limit uint32) bool {
+	min, maxExclusive := ValidMessageIDRange(limit)
+	return id >= min && id < maxExclusive
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"math/big"
 	"testing"
+	"time"
 
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,3 +53,123 @@ func TestHashToBN255(t *testing.T) {
 		[32]byte{69, 7, 140, 46, 26, 131, 147, 30, 161, 68, 2, 5, 234, 195, 227, 223, 119, 187, 116, 97, 153, 70, 71, 254, 60, 149, 54, 109, 77, 79, 105, 20},
 		out)
 }
+
+func TestIsFieldElement(t *testing.T) {
+	require.True(t, isFieldElement([32]byte{}))
+	require.True(t, isFieldElement(BigIntToBytes32(new(big.Int).Sub(fr.Modulus(), big.NewInt(1)))))
+	require.False(t, isFieldElement(BigIntToBytes32(fr.Modulus())))
+
+	var max [32]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	require.False(t, isFieldElement(max))
+}
+
+func TestFromIdentityCredentials(t *testing.T) {
+	creds, err := ToIdentityCredentials(STATIC_GROUP_KEYS)
+	require.NoError(t, err)
+
+	groupKeys := FromIdentityCredentials(creds)
+	require.Equal(t, STATIC_GROUP_KEYS, groupKeys)
+
+	parsedCreds, err := ToIdentityCredentials(groupKeys)
+	require.NoError(t, err)
+	require.Equal(t, creds, parsedCreds)
+}
+
+func TestIDSecretHashEquals(t *testing.T) {
+	secret := IDSecretHash{0x01, 0x02}
+	require.True(t, IDSecretHashEquals(secret, IDSecretHash{0x01, 0x02}))
+	require.False(t, IDSecretHashEquals(secret, IDSecretHash{0x01, 0x03}))
+	require.False(t, IDSecretHashEquals(secret, IDSecretHash{}))
+}
+
+func TestProofsAgree(t *testing.T) {
+	proof := RateLimitProof{
+		Proof:             ZKSNARK{0x01},
+		MerkleRoot:        MerkleNode{0x02},
+		ExternalNullifier: Nullifier{0x03},
+		ShareX:            MerkleNode{0x04},
+		ShareY:            MerkleNode{0x05},
+		Nullifier:         Nullifier{0x06},
+	}
+
+	otherZKProof := proof
+	otherZKProof.Proof = ZKSNARK{0x07}
+	require.True(t, ProofsAgree(proof, otherZKProof))
+
+	otherShare := proof
+	otherShare.ShareY = MerkleNode{0x07}
+	require.False(t, ProofsAgree(proof, otherShare))
+
+	otherRoot := proof
+	otherRoot.MerkleRoot = MerkleNode{0x07}
+	require.False(t, ProofsAgree(proof, otherRoot))
+}
+
+func TestValidMessageIDRange(t *testing.T) {
+	min, maxExclusive := ValidMessageIDRange(10)
+	require.Equal(t, uint32(0), min)
+	require.Equal(t, uint32(10), maxExclusive)
+
+	require.True(t, IsValidMessageID(0, 10))
+	require.True(t, IsValidMessageID(9, 10))
+	require.False(t, IsValidMessageID(10, 10))
+	require.False(t, IsValidMessageID(0, 0))
+}
+
+func TestLengthPrefix(t *testing.T) {
+	require.Equal(t, []byte{3, 0, 0, 0, 0, 0, 0, 0, 0xaa, 0xbb, 0xcc}, LengthPrefix([]byte{0xaa, 0xbb, 0xcc}))
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0}, LengthPrefix(nil))
+
+	input := make([]byte, 64)
+	require.Equal(t, append([]byte{2, 0, 0, 0, 0, 0, 0, 0}, input...), LengthPrefix32(input))
+}
+
+func TestFindDoubleSignals(t *testing.T) {
+	proof1 := RateLimitProof{Nullifier: Nullifier{0x01}, ShareX: MerkleNode{0x01}, ShareY: MerkleNode{0x01}}
+	proof2 := RateLimitProof{Nullifier: Nullifier{0x01}, ShareX: MerkleNode{0x02}, ShareY: MerkleNode{0x02}}
+	proof3 := RateLimitProof{Nullifier: Nullifier{0x02}, ShareX: MerkleNode{0x03}, ShareY: MerkleNode{0x03}}
+
+	// the same message seen twice is not a double signal
+	result := FindDoubleSignals([]RateLimitProof{proof1, proof3, proof1, proof3, proof2})
+	require.Equal(t, map[Nullifier][]RateLimitProof{
+		{0x01}: {proof1, proof2},
+	}, result)
+
+	require.Empty(t, FindDoubleSignals(nil))
+}
+
+func TestRootHistoryWindow(t *testing.T) {
+	history := NewRootHistory()
+	require.Empty(t, history.Window(time.Unix(1000, 0), time.Minute))
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, history.Add(MerkleNode{byte(i)}, time.Unix(int64(i*100), 0)))
+	}
+
+	require.Error(t, history.Add(MerkleNode{0x06}, time.Unix(100, 0)))
+
+	// the root current at the start of the window is included
+	require.Equal(t, [][32]byte{{0x04}, {0x03}}, history.Window(time.Unix(450, 0), 120*time.Second))
+	require.Equal(t, [][32]byte{{0x05}}, history.Window(time.Unix(1000, 0), time.Minute))
+
+	// roots added after now are not included
+	require.Equal(t, [][32]byte{{0x02}, {0x01}}, history.Window(time.Unix(250, 0), time.Minute*2))
+	require.Empty(t, history.Window(time.Unix(50, 0), time.Minute))
+
+	history.Prune(time.Unix(350, 0))
+	require.Equal(t, 3, history.Len())
+	require.Equal(t, [][32]byte{{0x05}, {0x04}, {0x03}}, history.Window(time.Unix(1000, 0), time.Hour))
+}
+
+func TestPoseidonHashWithoutInstance(t *testing.T) {
+	// the poseidon hash of two zero leaves is the first level of an empty tree
+	hash, err := PoseidonHash(make([]byte, 32), make([]byte, 32))
+	require.NoError(t, err)
+	require.NotEqual(t, MerkleNode{}, hash)
+
+	_, err = Hash([]byte("Hello"))
+	require.NoError(t, err)
+}